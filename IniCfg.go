@@ -13,14 +13,16 @@
 package ini
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"sort"
 	"strings"
+	"time"
 )
 
 // GetSection returns a pointer to the requested IniSection object, or nil
@@ -34,18 +36,145 @@ func (this *IniCfg) GetSection(sectionName string) *IniSection {
 	return VoidSection
 }
 
+// DeleteKey removes every instance of the given key from the named section.
+// It returns false if the section or key was not present.
+func (this *IniCfg) DeleteKey(sectionName, key string) bool {
+	return this.GetSection(sectionName).DeleteKey(key)
+}
+
+// DeleteSection removes the named section, along with all of its key/value
+// pairs, from the configuration. It returns false if the section was not
+// present.
+func (this *IniCfg) DeleteSection(sectionName string) bool {
+	this.checkFrozen()
+
+	secName := cleanIniToken(sectionName)
+
+	sec, ok := this.Sections[secName]
+	if !ok {
+		return false
+	}
+
+	delete(this.Sections, secName)
+	this.keys = removeKey(this.keys, secName)
+	sec.cfg = nil
+
+	for _, doc := range this.docs {
+		for i := 0; i < len(doc.Lines); i++ {
+			line := doc.Lines[i]
+			if line.Kind != SectionLine || cleanIniToken(line.Name) != secName {
+				continue
+			}
+
+			// take any comment block directly above the header with it
+			start := i
+			for start > 0 && doc.Lines[start-1].Kind == CommentLine {
+				start--
+			}
+
+			doc.removeRange(start, doc.sectionBody(i))
+			i = start - 1
+		}
+	}
+
+	this.computeHash()
+
+	return true
+}
+
+// RenameSection changes the name of an existing section. ErrSectionNotFound is
+// returned if there is no section named oldName, and ErrSectionExists if a
+// different section named newName is already present.
+func (this *IniCfg) RenameSection(oldName, newName string) error {
+	this.checkFrozen()
+
+	if err := checkToken(newName); err != nil {
+		return err
+	}
+
+	oldSecName := cleanIniToken(oldName)
+	newSecName := cleanIniToken(newName)
+
+	sec, ok := this.Sections[oldSecName]
+	if !ok {
+		return ErrSectionNotFound
+	}
+
+	if _, ok := this.Sections[newSecName]; ok && oldSecName != newSecName {
+		return ErrSectionExists
+	}
+
+	for _, doc := range this.docs {
+		for _, line := range doc.Lines {
+			if line.Kind == SectionLine && cleanIniToken(line.Name) == oldSecName {
+				line.setToken(strings.TrimSpace(newName))
+				line.Name = line.token()
+			}
+		}
+	}
+
+	if oldSecName == newSecName {
+		return nil
+	}
+
+	delete(this.Sections, oldSecName)
+	this.keys = removeKey(this.keys, oldSecName)
+
+	sec.Name = newSecName
+	this.Sections[newSecName] = sec
+	this.keys = append(this.keys, newSecName)
+	sort.Strings(this.keys)
+
+	this.computeHash()
+
+	return nil
+}
+
+// Documents returns the lossless IniDocument representations of each of the
+// files contributing to the configuration, in the same order as Paths. The
+// documents should only be modified through the mutation methods of IniCfg,
+// IniSection and IniValue, which keep them in sync with Sections.
+func (this *IniCfg) Documents() []*IniDocument {
+	return this.docs
+}
+
 // Reparse forces a config file to be re-read and all IniSections and
 // IniValues to be reparsed. After parsing is complete, all hashes are also
-// recomputed.
+// recomputed. Any error encountered while reading the files is discarded and
+// the config is left with whatever could be parsed before the failure; use
+// TryReparse to detect such failures.
+//
+// Reparse modifies the IniCfg in place, and so must not be called while other
+// goroutines may be reading it. The ini monitor never reparses in place;
+// instead it publishes a new snapshot (see Snapshot).
 func (this *IniCfg) Reparse() {
-	this.Sections = make(map[string]*IniSection, 0)
-	this.keys = make([]string, 0)
-	this.parseConfig()
-	this.computeHash()
+	this.checkFrozen()
+
+	next, _ := this.parseConfig(nil)
+	this.commit(next)
+}
+
+// TryReparse behaves like Reparse, but returns the first error encountered
+// while opening or reading the config's files as a *ParseError. On error the
+// IniCfg is left untouched, retaining the values from its last successful
+// parse. If the config was loaded in strict mode, a *DiagnosticsError is
+// returned when any malformed lines are found.
+func (this *IniCfg) TryReparse() error {
+	this.checkFrozen()
+
+	next, err := this.parseConfig(nil)
+	if err != nil {
+		return err
+	}
+
+	this.commit(next)
+
+	return nil
 }
 
 // RawString prints the ini files exactly as read in from disk,
-// along with last write time and file hash.
+// along with last write time and file hash. Configs parsed from memory
+// are printed exactly as parsed.
 func (this *IniCfg) RawString() string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf(
@@ -55,9 +184,13 @@ func (this *IniCfg) RawString() string {
 	))
 
 	for index, path := range this.Paths {
-		buf.WriteString(fmt.Sprintf(
-			"File: %s\nLastWriteTime: %s\n", path, this.ModTimes[index],
-		))
+		if this.inMemory {
+			buf.WriteString(fmt.Sprintf("Source: %s\n", path))
+		} else {
+			buf.WriteString(fmt.Sprintf(
+				"File: %s\nLastWriteTime: %s\n", path, this.ModTimes[index],
+			))
+		}
 	
 		buf.WriteString("====================================================================\n\n")
 	
@@ -66,6 +199,72 @@ func (this *IniCfg) RawString() string {
 	return buf.String()
 }
 
+// Save atomically writes the configuration to the file at the given path in
+// the format produced by WriteTo. The data is first written to a temporary
+// file in the same directory which is then renamed over the destination, so
+// that the ini monitor never observes a partially written file.
+func (this *IniCfg) Save(iniPath string) error {
+	return writeFileAtomic(iniPath, this)
+}
+
+// SaveAll atomically writes each of the config's documents back to the file
+// it was read from, preserving comments and formatting. This is the means of
+// persisting edits to a config which was loaded from multiple files. Configs
+// parsed from memory have no files, and are left unwritten.
+func (this *IniCfg) SaveAll() error {
+	if this.inMemory {
+		return nil
+	}
+
+	for i, doc := range this.docs {
+		if doc.Path == "" || this.layerFS(i) != nil {
+			continue
+		}
+
+		if err := writeFileAtomic(doc.Path, doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetValue replaces every instance of the given key within the named section
+// with a single IniValue parsed from value, creating the section and key if
+// they do not already exist.
+func (this *IniCfg) SetValue(sectionName, key, value string) error {
+	this.checkFrozen()
+
+	if err := checkToken(sectionName); err != nil {
+		return err
+	}
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return this.ensureSection(sectionName).SetValue(key, value)
+}
+
+// Snapshot returns the most recent version of the configuration. When the
+// config is subscribed to the ini monitor, each detected change to its files
+// is parsed into a new, frozen IniCfg which is then published atomically, so
+// that the result of Snapshot is always complete and consistent and may be
+// read from any number of goroutines without locking. Attempting to modify
+// a frozen snapshot panics.
+//
+// If no changes have been published since the IniCfg was loaded, the IniCfg
+// itself is returned.
+func (this *IniCfg) Snapshot() *IniCfg {
+	if this.live != nil {
+		if cur, ok := this.live.cur.Load().(*IniCfg); ok {
+			return cur
+		}
+	}
+
+	return this
+}
+
 // String prints a human-readable text representation of the IniCfg
 // object heirarchy.
 func (this *IniCfg) String() string {
@@ -77,9 +276,13 @@ func (this *IniCfg) String() string {
 	))
 
 	for index, path := range this.Paths {
-		buf.WriteString(fmt.Sprintf(
-			"File: %s\nLastWriteTime: %s\n", path, this.ModTimes[index],
-		))
+		if this.inMemory {
+			buf.WriteString(fmt.Sprintf("Source: %s\n", path))
+		} else {
+			buf.WriteString(fmt.Sprintf(
+				"File: %s\nLastWriteTime: %s\n", path, this.ModTimes[index],
+			))
+		}
 	}
 
 	for i := range this.keys {
@@ -89,6 +292,37 @@ func (this *IniCfg) String() string {
 	return buf.String()
 }
 
+// WriteTo writes the configuration to w in ini format, such that parsing the
+// output results in an identical ConfigVer. When the config consists of a
+// single document, that document is written as is, preserving comments and
+// formatting. Otherwise the merged configuration is written out one section
+// at a time, and comments and formatting are lost; use SaveAll to write
+// multi-file configs back to their individual files.
+func (this *IniCfg) WriteTo(w io.Writer) (int64, error) {
+	if len(this.docs) == 1 {
+		return this.docs[0].WriteTo(w)
+	}
+
+	var buf bytes.Buffer
+
+	for i := range this.keys {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+
+		this.Sections[this.keys[i]].writeTo(&buf)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// checkFrozen panics if the IniCfg is a frozen snapshot.
+func (this *IniCfg) checkFrozen() {
+	if this.frozen {
+		panic("ini: attempt to modify a frozen IniCfg snapshot")
+	}
+}
+
 // computeHash recomputes the sha1 hash for the config file based
 // on a combination of the hashes of all IniSections.
 func (this *IniCfg) computeHash() {
@@ -105,6 +339,16 @@ func (this *IniCfg) computeHash() {
 	this.ConfigVer = fmt.Sprintf("%x", hash.Sum(nil))
 }
 
+// computeHashes recomputes the hash of each IniSection, followed by that of
+// the config itself.
+func (this *IniCfg) computeHashes() {
+	for i := range this.keys {
+		this.Sections[this.keys[i]].ComputeHash()
+	}
+
+	this.computeHash()
+}
+
 // getSection either returns a pre-existing IniSection with the given
 // sectionName, or creates a new one and returns that.
 func (this *IniCfg) getSection(sectionName string) *IniSection {
@@ -115,6 +359,7 @@ func (this *IniCfg) getSection(sectionName string) *IniSection {
 	}
 
 	sec := newIniSection(secName)
+	sec.cfg = this
 	this.Sections[secName] = sec
 	this.keys = append(this.keys, secName)
 	sort.Strings(this.keys)
@@ -122,69 +367,416 @@ func (this *IniCfg) getSection(sectionName string) *IniSection {
 	return sec
 }
 
-// parseConfig opens the ini file, parses its sections and key/val
-// pairs, and recomputes hashes for all IniSections.
-func (this *IniCfg) parseConfig() {
-	for iniFilePathIndex, iniFilePath := range this.Paths {
-		f, err := os.Open(iniFilePath)
-		if err != nil {
-			return
+// commit replaces the parsed state of the IniCfg with that of next, which
+// must have been produced by parseConfig.
+func (this *IniCfg) commit(next *IniCfg) {
+	this.ConfigVer = next.ConfigVer
+	this.ModTimes = next.ModTimes
+	this.Paths = next.Paths
+	this.Raws = next.Raws
+	this.Sections = next.Sections
+	this.Warnings = next.Warnings
+	this.docs = next.docs
+	this.fsys = next.fsys
+	this.globs = next.globs
+	this.included = next.included
+	this.keys = next.keys
+
+	for i := range this.keys {
+		this.Sections[this.keys[i]].cfg = this
+	}
+}
+
+// parseConfig opens the ini files, parses their sections and key/val
+// pairs, and recomputes hashes for all IniSections. The results are
+// returned in a new IniCfg object so that the caller may decide whether
+// or not to commit them. If an error is encountered the returned IniCfg
+// contains everything parsed up until the failure. If last is not nil, files
+// which no longer exist are parsed from their contents in last.
+func (this *IniCfg) parseConfig(last *IniCfg) (*IniCfg, error) {
+	next := &IniCfg{
+		Name:     this.Name,
+		Sections: make(map[string]*IniSection, 0),
+		inMemory: this.inMemory,
+		keys:     make([]string, 0),
+		last:     last,
+		opts:     this.opts,
+	}
+
+	if this.inMemory {
+		next.Paths = this.Paths
+		next.ModTimes = make([]time.Time, len(this.Paths))
+		next.Raws = make([]string, len(this.Paths))
+		copy(next.Raws, this.Raws)
+	}
+
+	err := next.parseFiles(this.rootLayers())
+	next.last = nil
+	if err == nil && next.opts.Interpolate {
+		next.interpolate()
+	}
+
+	if err == nil && len(next.errs) > 0 {
+		err = &DiagnosticsError{Diagnostics: next.errs}
+	}
+
+	if err == nil && next.opts.Strict && len(next.Warnings) > 0 {
+		err = &DiagnosticsError{Diagnostics: next.Warnings}
+	}
+
+	next.computeHashes()
+
+	return next, err
+}
+
+// publish atomically makes next the snapshot returned by Snapshot for this
+// IniCfg and all other snapshots derived from it.
+func (this *IniCfg) publish(next *IniCfg) {
+	this.live.cur.Store(next)
+}
+
+// reload parses the config's files into a new, frozen IniCfg which shares
+// the config's published snapshot. The IniCfg itself is left untouched. On
+// error, the new IniCfg is returned along with the error, holding everything
+// parsed up until the failure, so that the rejected version can be reported.
+// Unless the IgnoreMissing option is set, files which have been removed keep
+// their last contents.
+func (this *IniCfg) reload() (*IniCfg, error) {
+	next, err := this.parseConfig(this)
+
+	next.frozen = true
+	next.live = this.live
+
+	return next, err
+}
+
+// parseFiles does the work of reading each of the given files in turn,
+// along with any files they include, and adding their sections and key/val
+// pairs to the IniCfg. Configs parsed from memory are parsed again from their
+// Raws. Should a file fail to be read, the remaining files are still added to
+// Paths, so that the monitor notices once they can be read.
+func (this *IniCfg) parseFiles(roots []Layer) error {
+	if this.inMemory {
+		for iniFilePathIndex, iniFilePath := range this.Paths {
+			doc := parseDocument(iniFilePath, this.Raws[iniFilePathIndex])
+			this.docs = append(this.docs, doc)
+			this.addDocument(doc)
 		}
-		defer f.Close()
 
-		info, err := os.Stat(iniFilePath)
+		return nil
+	}
+
+	loaded := make(map[string]bool)
+	active := make(map[string]bool)
+
+	for i := range roots {
+		err := this.includeFile(roots[i], i, false, loaded, active)
 		if err != nil {
-			return
+			for _, root := range roots[i+1:] {
+				this.addPath(root, false)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// layerFS returns the file system from which the config file at the given
+// index is read, or nil if it is read from the operating system.
+func (this *IniCfg) layerFS(index int) fs.FS {
+	if index < len(this.fsys) {
+		return this.fsys[index]
+	}
+
+	return nil
+}
+
+// hasFSLayers returns true if any of the config's files, or the patterns of
+// any globs it includes, are read from an fs.FS rather than the operating
+// system, and so cannot be watched.
+func (this *IniCfg) hasFSLayers() bool {
+	for i := range this.Paths {
+		if this.layerFS(i) != nil {
+			return true
+		}
+	}
+
+	for i := range this.globs {
+		if this.globs[i].fsys != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// open opens the config file at the given index.
+func (this *IniCfg) open(index int) (fs.File, error) {
+	if fsys := this.layerFS(index); fsys != nil {
+		return fsys.Open(this.Paths[index])
+	}
+
+	return os.Open(this.Paths[index])
+}
+
+// readContent returns the current content of the config file at the given
+// index.
+func (this *IniCfg) readContent(index int) ([]byte, error) {
+	f, err := this.open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// readFile reads the content and modification time of the config file at the
+// given index into Raws and ModTimes. A missing file is read as empty if the
+// IgnoreMissing option is set, or otherwise with its contents from the last
+// parse, if there was one in which it was read.
+func (this *IniCfg) readFile(index int) error {
+	iniFilePath := this.Paths[index]
+
+	f, err := this.open(index)
+	if err != nil && os.IsNotExist(err) && this.opts.IgnoreMissing {
+		return nil
+	}
+
+	if err != nil && os.IsNotExist(err) && this.last != nil {
+		if last := this.last.findPath(this, index); last >= 0 {
+			this.ModTimes[index] = this.last.ModTimes[last]
+			this.Raws[index] = this.last.Raws[last]
+
+			return nil
 		}
+	}
 
-		this.ModTimes[iniFilePathIndex] = info.ModTime()
+	if err != nil {
+		return &ParseError{Path: iniFilePath, Err: err}
+	}
+	defer f.Close()
 
-		var curSection *IniSection
-		scanner := bufio.NewScanner(f)
+	info, err := f.Stat()
+	if err != nil {
+		return &ParseError{Path: iniFilePath, Err: err}
+	}
 
-		var buf bytes.Buffer
+	this.ModTimes[index] = info.ModTime()
 
-		for scanner.Scan() {
-			if scanner.Err() != nil {
-				break
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return &ParseError{Path: iniFilePath, Err: err}
+	}
+
+	this.Raws[index] = string(content)
+
+	return nil
+}
+
+// findPath returns the index of the file in this config which corresponds to
+// the file at the given index within other, or -1 if there is none. Files
+// read from an fs.FS cannot be compared, so are matched by path alone.
+func (this *IniCfg) findPath(other *IniCfg, index int) int {
+	isFS := other.layerFS(index) != nil
+
+	for i := range this.Paths {
+		if this.Paths[i] == other.Paths[index] && (this.layerFS(i) != nil) == isFS {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// stat returns information about the config file at the given index.
+func (this *IniCfg) stat(index int) (fs.FileInfo, error) {
+	if fsys := this.layerFS(index); fsys != nil {
+		return fs.Stat(fsys, this.Paths[index])
+	}
+
+	return os.Stat(this.Paths[index])
+}
+
+// addDocument walks the lines of the given document, adding its sections and
+// key/val pairs to the IniCfg and recording a Diagnostic for every line that
+// has to be skipped.
+func (this *IniCfg) addDocument(doc *IniDocument) {
+	var curSection *IniSection
+
+	for _, line := range doc.Lines {
+		warn := func(msg string) {
+			this.Warnings = append(this.Warnings, Diagnostic{
+				Path:    doc.Path,
+				Line:    line.Num,
+				Column:  line.column(),
+				Message: msg,
+			})
+		}
+
+		switch line.Kind {
+		case SectionLine:
+			if strings.TrimSpace(line.Name) == "" {
+				warn("empty section name")
 			}
 
-			line := strings.TrimSpace(scanner.Text())
-			buf.WriteString(fmt.Sprintf("%s\n", line))
+			// new or next section
+			curSection = this.getSection(line.Name)
 
-			if len(line) < 1 ||
-				strings.HasPrefix(line, "#") ||
-				strings.HasPrefix(line, ";") {
+		case KeyValLine:
+			// orphaned lines
+			if curSection == nil && isIncludeKey(line.Name) {
+				this.checkInclude(line, warn)
 				continue
 			}
 
-			section := secRegexp.FindStringSubmatch(line)
-			if len(section) > 0 && curSection == nil {
-				// new section
-				curSection = this.getSection(section[1])
-			} else if len(section) > 0 && curSection != nil {
-				// next section
-				curSection = this.getSection(section[1])
-			} else if curSection == nil {
-				// orphaned lines
+			if curSection == nil {
+				warn("key/value pair appears before any section header")
 				continue
 			}
 
-			// poorly formatted lines
-			keyval := keyvalRegexp.FindStringSubmatch(line)
-			if len(keyval) < 1 {
-				continue
+			if line.Name == "" {
+				warn("key/value pair is missing a key")
+			}
+
+			key, strategy := this.mergeStrategy(line.Name)
+			ckey := cleanIniToken(key)
+
+			// instances from an earlier file
+			prev := curSection.Values[ckey]
+			if len(prev) > 0 && prev[len(prev)-1].doc != doc {
+				switch strategy {
+				case MergeOverride:
+					delete(curSection.Values, ckey)
+					curSection.keys = removeKey(curSection.keys, ckey)
+
+				case MergeFirstWins:
+					continue
+
+				case MergeError:
+					this.errs = append(this.errs, Diagnostic{
+						Path:   doc.Path,
+						Line:   line.Num,
+						Column: line.column(),
+						Message: fmt.Sprintf(
+							"key %q in section [%s] is already defined at %s:%d",
+							ckey,
+							curSection.Name,
+							prev[0].doc.Path,
+							prev[0].line.Num,
+						),
+					})
+					continue
+				}
 			}
 
-			// curSection keyval
-			curSection.AddValue(keyval[1], keyval[2])
+			val, err := this.parseValue(key, line.token())
+			if err != nil {
+				this.errs = append(this.errs, Diagnostic{
+					Path:    doc.Path,
+					Line:    line.Num,
+					Column:  line.column(),
+					Message: err.Error(),
+				})
+			}
+
+			curSection.addValue(val, doc, line)
+
+		case IncludeLine:
+			this.checkInclude(line, warn)
+
+		case InvalidLine:
+			// poorly formatted lines
+			warn(line.problem)
 		}
+	}
+}
 
-		this.Raws[iniFilePathIndex] = string(buf.Bytes())
+// parseValue returns a new IniValue for the given key and value, read from
+// one of the config's files. If the ExpandEnv option is set, references to
+// environment variables within the value are expanded; under StrictEnv, an
+// error is returned if any of them are not set. When the Interpolate option
+// is set, expansion is instead left until all of the config's files have
+// been merged (see interpolate).
+func (this *IniCfg) parseValue(key, value string) (*IniValue, error) {
+	var expand func(string) (string, error)
+	if this.opts.ExpandEnv && !this.opts.Interpolate {
+		expand = func(value string) (string, error) {
+			return expandRefs(
+				value,
+				lookupEnv,
+				this.opts.StrictEnv,
+				"environment variable %q is not set",
+			)
+		}
 	}
 
-	// compute hash of each section
-	for i := range this.keys {
-		this.Sections[this.keys[i]].ComputeHash()
+	val := IniValue{
+		Name: cleanIniToken(key),
+	}
+
+	err := val.parseValues(value, expand)
+
+	return &val, err
+}
+
+// mergeStrategy returns the given key, stripped of any merge marker, and the
+// strategy with which it should be merged with instances from earlier files.
+func (this *IniCfg) mergeStrategy(key string) (string, MergeStrategy) {
+	trimmed := strings.TrimSpace(key)
+
+	if len(trimmed) > 1 {
+		switch trimmed[0] {
+		case '!':
+			return trimmed[1:], MergeOverride
+		case '+':
+			return trimmed[1:], MergeAppend
+		}
+	}
+
+	return key, this.opts.Merge
+}
+
+// editDoc returns the document to which new sections should be added. This
+// is the last of the config's documents, so that additions take precedence
+// over values from earlier files.
+func (this *IniCfg) editDoc() *IniDocument {
+	if len(this.docs) < 1 {
+		this.docs = append(this.docs, &IniDocument{
+			Lines: make([]*IniLine, 0),
+		})
 	}
+
+	return this.docs[len(this.docs)-1]
+}
+
+// ensureSection either returns a pre-existing IniSection with the given
+// sectionName, or creates a new one, appending its header to the config's
+// last document.
+func (this *IniCfg) ensureSection(sectionName string) *IniSection {
+	if sec, ok := this.Sections[cleanIniToken(sectionName)]; ok {
+		return sec
+	}
+
+	doc := this.editDoc()
+	if n := len(doc.Lines); n > 0 && doc.Lines[n-1].Kind != BlankLine {
+		doc.insert(n, newIniLine(""))
+	}
+
+	doc.insert(len(doc.Lines), newSectionLine(sectionName))
+
+	return this.getSection(sectionName)
+}
+
+// removeKey returns keys with the first instance of key removed.
+func removeKey(keys []string, key string) []string {
+	for i := range keys {
+		if keys[i] == key {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+
+	return keys
 }
@@ -0,0 +1,314 @@
+//  ---------------------------------------------------------------------------
+//
+//  IniDocument.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// LineKind identifies the syntactic role of a single IniLine.
+type LineKind int
+
+// Supported line kinds.
+const (
+	BlankLine LineKind = iota
+	CommentLine
+	SectionLine
+	KeyValLine
+	InvalidLine
+	IncludeLine
+)
+
+// IniDocument is a lossless representation of a single ini file. Writing an
+// unmodified IniDocument reproduces the original file byte for byte,
+// including comments, blank lines, white space, line endings and the original
+// casing of section names and keys. Edits made through the IniCfg, IniSection
+// and IniValue mutation methods are applied to the affected lines only, so
+// that saving the document produces a minimal diff against the original.
+type IniDocument struct {
+	Path  string
+	Lines []*IniLine
+}
+
+// IniLine represents a single line within an IniDocument. Raw is the text of
+// the line without its terminator, which is held separately in EOL ("\n",
+// "\r\n", or "" for an unterminated final line). Num is the 1-based line
+// number at which the line was originally read, or 0 for lines which were
+// added by an edit. For section and key/value lines, Name holds the section
+// name or key exactly as written. For include directives (ex: !include
+// app.d/*.ini), Name holds the directive without its leading '!'.
+type IniLine struct {
+	Kind LineKind
+	Raw  string
+	EOL  string
+	Num  int
+	Name string
+
+	// tokStart and tokEnd are the byte offsets within Raw of the section
+	// name (for section lines), the value (for key/value lines) or the
+	// path (for include lines).
+	tokStart int
+	tokEnd   int
+	problem  string
+}
+
+// String returns the document exactly as it would be written to disk.
+func (this *IniDocument) String() string {
+	var buf bytes.Buffer
+	this.WriteTo(&buf)
+
+	return buf.String()
+}
+
+// WriteTo writes the document to w.
+func (this *IniDocument) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	for i := range this.Lines {
+		buf.WriteString(this.Lines[i].Raw)
+		buf.WriteString(this.Lines[i].EOL)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// eol returns the line terminator used by the document, based on its first
+// line.
+func (this *IniDocument) eol() string {
+	if len(this.Lines) > 0 && this.Lines[0].EOL != "" {
+		return this.Lines[0].EOL
+	}
+
+	return "\n"
+}
+
+// indexOf returns the index of the given line within the document, or -1
+// if it is not present.
+func (this *IniDocument) indexOf(line *IniLine) int {
+	for i := range this.Lines {
+		if this.Lines[i] == line {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// insert adds line to the document at index idx, terminating it in the same
+// manner as the rest of the document.
+func (this *IniDocument) insert(idx int, line *IniLine) {
+	line.EOL = this.eol()
+
+	if idx == len(this.Lines) && idx > 0 && this.Lines[idx-1].EOL == "" {
+		// preserve a missing trailing newline
+		this.Lines[idx-1].EOL = line.EOL
+		line.EOL = ""
+	}
+
+	this.Lines = append(this.Lines, nil)
+	copy(this.Lines[idx+1:], this.Lines[idx:])
+	this.Lines[idx] = line
+}
+
+// remove deletes the given line from the document.
+func (this *IniDocument) remove(line *IniLine) {
+	idx := this.indexOf(line)
+	if idx < 0 {
+		return
+	}
+
+	this.removeRange(idx, idx+1)
+}
+
+// removeRange deletes the lines in the range [start, end) from the
+// document.
+func (this *IniDocument) removeRange(start, end int) {
+	if end == len(this.Lines) && start > 0 && this.Lines[end-1].EOL == "" {
+		// preserve a missing trailing newline
+		this.Lines[start-1].EOL = ""
+	}
+
+	this.Lines = append(this.Lines[:start], this.Lines[end:]...)
+}
+
+// sectionBody returns the index just past the last key/value, include (or
+// unrecognized) line belonging to the section whose header is at index idx.
+// Trailing blank lines and comments are considered to belong to whatever
+// follows the section.
+func (this *IniDocument) sectionBody(idx int) int {
+	end := idx + 1
+
+	for i := idx + 1; i < len(this.Lines); i++ {
+		kind := this.Lines[i].Kind
+		if kind == SectionLine {
+			break
+		}
+
+		if kind == KeyValLine || kind == InvalidLine || kind == IncludeLine {
+			end = i + 1
+		}
+	}
+
+	return end
+}
+
+// column returns the 1-based column of the first non-whitespace byte in
+// the line.
+func (this *IniLine) column() int {
+	trimmed := strings.TrimLeft(this.Raw, " \t\ufeff")
+	return len(this.Raw) - len(trimmed) + 1
+}
+
+// setToken replaces the section name or value held by the line, leaving
+// the rest of the line, including any trailing comment, untouched.
+func (this *IniLine) setToken(token string) {
+	tail := this.Raw[this.tokEnd:]
+	if token != "" && strings.HasPrefix(tail, "#") {
+		tail = " " + tail
+	}
+
+	this.Raw = this.Raw[:this.tokStart] + token + tail
+	this.tokEnd = this.tokStart + len(token)
+}
+
+// token returns the section name or value held by the line.
+func (this *IniLine) token() string {
+	return this.Raw[this.tokStart:this.tokEnd]
+}
+
+// newKeyValLine returns a new key/value line with the given indentation.
+func newKeyValLine(indent, key, value string) *IniLine {
+	return newIniLine(indent + strings.TrimSpace(key) + " = " + value)
+}
+
+// newSectionLine returns a new section header line.
+func newSectionLine(sectionName string) *IniLine {
+	return newIniLine("[" + strings.TrimSpace(sectionName) + "]")
+}
+
+// newIniLine returns a pointer to a new IniLine object, classified according
+// to the contents of raw.
+func newIniLine(raw string) *IniLine {
+	line := IniLine{
+		Raw: raw,
+	}
+
+	line.classify()
+
+	return &line
+}
+
+// parseDocument splits the given file content into lines and classifies
+// each of them, returning the resulting IniDocument.
+func parseDocument(docPath, content string) *IniDocument {
+	doc := IniDocument{
+		Path:  docPath,
+		Lines: make([]*IniLine, 0),
+	}
+
+	for num := 1; len(content) > 0; num++ {
+		raw := content
+		eol := ""
+
+		if idx := strings.Index(content, "\n"); idx >= 0 {
+			raw = content[:idx]
+			eol = "\n"
+			content = content[idx+1:]
+		} else {
+			content = ""
+		}
+
+		if strings.HasSuffix(raw, "\r") {
+			raw = raw[:len(raw)-1]
+			eol = "\r" + eol
+		}
+
+		line := newIniLine(raw)
+		line.EOL = eol
+		line.Num = num
+
+		doc.Lines = append(doc.Lines, line)
+	}
+
+	return &doc
+}
+
+// classify determines the kind of the line and the location of its
+// section name or value.
+func (this *IniLine) classify() {
+	lead := this.column() - 1
+	line := strings.TrimSpace(this.Raw[lead:])
+
+	switch {
+	case len(line) < 1:
+		this.Kind = BlankLine
+
+	case strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		this.Kind = CommentLine
+
+	case secRegexp.MatchString(line):
+		this.Kind = SectionLine
+		this.tokStart = lead + 1
+		this.tokEnd = strings.LastIndex(this.Raw, "]")
+		this.Name = this.token()
+
+	case strings.HasPrefix(line, "["):
+		this.Kind = InvalidLine
+		if strings.Contains(line, "]") {
+			this.problem = "unexpected text after section header"
+		} else {
+			this.problem = "section header is missing a closing ']'"
+		}
+
+	case includeRegexp.MatchString(line):
+		this.Name = includeRegexp.FindStringSubmatch(line)[1]
+		this.findValue(lead + 1 + len(this.Name))
+
+		if this.tokEnd > this.tokStart {
+			this.Kind = IncludeLine
+		} else {
+			this.Kind = InvalidLine
+			this.problem = "include directive is missing a path"
+		}
+
+	case keyvalRegexp.MatchString(line):
+		eq := strings.Index(this.Raw, "=")
+		this.Kind = KeyValLine
+		this.Name = strings.TrimSpace(this.Raw[lead:eq])
+		this.findValue(eq + 1)
+
+	default:
+		this.Kind = InvalidLine
+		this.problem = "line is neither a section header nor a key/value pair"
+	}
+}
+
+// findValue locates the value which begins at or after the given offset
+// within Raw, skipping leading white space and stopping at any trailing
+// comment.
+func (this *IniLine) findValue(start int) {
+	this.tokStart = start
+	for this.tokStart < len(this.Raw) &&
+		(this.Raw[this.tokStart] == ' ' || this.Raw[this.tokStart] == '\t') {
+		this.tokStart++
+	}
+
+	value := this.Raw[this.tokStart:]
+	if idx := strings.Index(value, "#"); idx >= 0 {
+		value = value[:idx]
+	}
+
+	this.tokEnd = this.tokStart + len(strings.TrimRight(value, " \t"))
+}
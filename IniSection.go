@@ -18,6 +18,7 @@ import (
     "fmt"
     "io"
     "sort"
+    "strings"
 )
 
 // VoidSection is returned by GetSection so that subsequent calls to GetVal
@@ -25,20 +26,14 @@ import (
 var VoidSection = newIniSection("void")
 
 // AddValue adds a new IniValue object for the given key and value strings
-// to the IniSection instance.
+// to the IniSection instance. If the section belongs to an IniCfg, a
+// corresponding line is also added to the last instance of the section
+// within the config's documents.
 func (this *IniSection) AddValue(key, value string) {
-    ckey   := cleanIniToken(key)
-    newVal := newIniValue(ckey, value)
+    this.checkFrozen()
 
-    if _, ok := this.Values[ckey]; ok {
-        this.Values[ckey] = append(this.Values[ckey], newVal)
-    } else {
-        newValArray             := make([]*IniValue, 1)
-        newValArray[0]           = newVal
-        this.Values[newVal.Name] = newValArray
-        this.keys                = append(this.keys, newVal.Name)
-        sort.Strings(this.keys)
-    }
+    doc, line := this.insertLine(key, stripEOLComment(value))
+    this.addValue(newIniValue(key, value), doc, line)
 }
 
 // ComputeHash recomputes the sha1 hash of all the key/val pairs within
@@ -59,6 +54,33 @@ func (this *IniSection) ComputeHash() {
     this.ConfigVer = fmt.Sprintf("%x", hash.Sum(nil))
 }
 
+// DeleteKey removes every IniValue object with a matching key name from the
+// section. It returns false if no such IniValue objects were present.
+func (this *IniSection) DeleteKey(key string) bool {
+    ckey := cleanIniToken(key)
+
+    if this == VoidSection {
+        return false
+    }
+
+    this.checkFrozen()
+
+    vals, ok := this.Values[ckey]
+    if !ok {
+        return false
+    }
+
+    for i := range vals {
+        vals[i].unlink()
+    }
+
+    delete(this.Values, ckey)
+    this.keys = removeKey(this.keys, ckey)
+    this.changed()
+
+    return true
+}
+
 // GetFirstVal returns a pointer to the first IniValue object with a matching
 // key name. Returns nil if no relevant IniValue objects are present in the 
 // section.
@@ -72,6 +94,31 @@ func (this *IniSection) GetFirstVal(valName string) *IniValue {
     return vals[0]
 }
 
+// GetVal returns a pointer to the IniValue object which takes precedence among
+// those with a matching key name: the first instance if the config uses the
+// MergeFirstWins strategy, and the last otherwise, so that values from later
+// files override those from earlier ones. Returns VoidValue if no relevant
+// IniValue objects are present in the section.
+func (this *IniSection) GetVal(valName string) *IniValue {
+    vals := this.GetVals(valName)
+
+    if len(vals) < 1 {
+        return VoidValue
+    }
+
+    return vals[this.precedent(len(vals))]
+}
+
+// precedent returns the index of the instance which takes precedence among
+// count instances of a key, as described by GetVal.
+func (this *IniSection) precedent(count int) int {
+    if this.cfg != nil && this.cfg.opts.Merge == MergeFirstWins {
+        return 0
+    }
+
+    return count - 1
+}
+
 // GetVals returns an array of pointers to IniValue objects with matching key
 // names. Returns nil if no relevant IniValue objects are present in the section.
 func (this *IniSection) GetVals(valName string) []*IniValue {
@@ -83,6 +130,56 @@ func (this *IniSection) GetVals(valName string) []*IniValue {
     return make([]*IniValue, 0)
 }
 
+// SetValue replaces every instance of the given key within the section with
+// a single IniValue parsed from value, in the same manner as AddValue. The key
+// is created if it does not already exist.
+func (this *IniSection) SetValue(key, value string) error {
+    if this == VoidSection {
+        return ErrVoid
+    }
+
+    this.checkFrozen()
+
+    if err := checkKey(key); err != nil {
+        return err
+    }
+
+    if strings.ContainsAny(value, "\r\n") {
+        return fmt.Errorf("ini: value %q cannot be represented in an ini file", value)
+    }
+
+    ckey   := cleanIniToken(key)
+    newVal := newIniValue(ckey, value)
+    newVal.section = this
+
+    if vals, ok := this.Values[ckey]; ok {
+        // edit the first instance of the key in place, remove the rest
+        newVal.doc  = vals[0].doc
+        newVal.line = vals[0].line
+
+        if newVal.line != nil {
+            newVal.line.setToken(stripEOLComment(value))
+        }
+
+        vals[0].doc     = nil
+        vals[0].line    = nil
+        vals[0].section = nil
+
+        for i := 1; i < len(vals); i++ {
+            vals[i].unlink()
+        }
+    } else {
+        newVal.doc, newVal.line = this.insertLine(key, stripEOLComment(value))
+        this.keys = append(this.keys, ckey)
+        sort.Strings(this.keys)
+    }
+
+    this.Values[ckey] = []*IniValue{newVal}
+    this.changed()
+
+    return nil
+}
+
 // String prints a human-readable representation of the IniSection and
 // its children IniValue objects.
 func (this *IniSection) String() string {
@@ -102,3 +199,91 @@ func (this *IniSection) String() string {
     return buf.String()
 }
 
+// addValue adds the given IniValue object to the IniSection instance,
+// associating it with the document line it was read from.
+func (this *IniSection) addValue(newVal *IniValue, doc *IniDocument, line *IniLine) {
+    ckey := newVal.Name
+
+    newVal.doc     = doc
+    newVal.line    = line
+    newVal.section = this
+
+    if _, ok := this.Values[ckey]; ok {
+        this.Values[ckey] = append(this.Values[ckey], newVal)
+    } else {
+        newValArray             := make([]*IniValue, 1)
+        newValArray[0]           = newVal
+        this.Values[newVal.Name] = newValArray
+        this.keys                = append(this.keys, newVal.Name)
+        sort.Strings(this.keys)
+    }
+}
+
+// checkFrozen panics if the section belongs to a frozen IniCfg snapshot.
+func (this *IniSection) checkFrozen() {
+    if this.cfg != nil {
+        this.cfg.checkFrozen()
+    }
+}
+
+// changed recomputes the hash of the section, as well as that of its parent
+// IniCfg, after a modification.
+func (this *IniSection) changed() {
+    this.ComputeHash()
+
+    if this.cfg != nil {
+        this.cfg.computeHash()
+    }
+}
+
+// insertLine adds a new key/value line to the last instance of the section
+// within its config's documents, directly after the section's last key,
+// and returns the document and line. Nil is returned for both if the
+// section does not belong to a config.
+func (this *IniSection) insertLine(key, value string) (*IniDocument, *IniLine) {
+    if this.cfg == nil {
+        return nil, nil
+    }
+
+    for d := len(this.cfg.docs) - 1; d >= 0; d-- {
+        doc := this.cfg.docs[d]
+
+        for i := len(doc.Lines) - 1; i >= 0; i-- {
+            hdr := doc.Lines[i]
+            if hdr.Kind != SectionLine || cleanIniToken(hdr.Name) != this.Name {
+                continue
+            }
+
+            // match the indentation of the preceding key
+            end    := doc.sectionBody(i)
+            indent := ""
+            if end > i + 1 {
+                prev  := doc.Lines[end - 1]
+                indent = prev.Raw[:prev.column() - 1]
+            }
+
+            line := newKeyValLine(indent, key, value)
+            doc.insert(end, line)
+
+            return doc, line
+        }
+    }
+
+    return nil, nil
+}
+
+// writeTo writes the section header and all of its key/value pairs to buf
+// in ini format.
+func (this *IniSection) writeTo(buf *bytes.Buffer) {
+    buf.WriteString(fmt.Sprintf("[%s]\n", this.Name))
+
+    for x := range this.keys {
+        for y := range this.Values[this.keys[x]] {
+            buf.WriteString(fmt.Sprintf(
+                "%s = %s\n",
+                this.keys[x],
+                strings.Join(this.Values[this.keys[x]][y].Values, ", "),
+            ))
+        }
+    }
+}
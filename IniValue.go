@@ -150,6 +150,41 @@ func (this *IniValue) GetValUint64(offset int, defVal uint64) uint64 {
     return uVal
 }
 
+// SetValues replaces the values held by the IniValue object. Individual
+// values may not contain commas, comment characters, line breaks, or
+// enclosing white space, since they could not be read back in unchanged.
+func (this *IniValue) SetValues(values ...string) error {
+    if this == VoidValue {
+        return ErrVoid
+    }
+
+    if this.section != nil {
+        this.section.checkFrozen()
+    }
+
+    for i := range values {
+        if err := checkValue(values[i]); err != nil {
+            return err
+        }
+    }
+
+    if len(values) < 1 {
+        values = []string{""}
+    }
+
+    this.Values = append(make([]string, 0, len(values)), values...)
+
+    if this.line != nil {
+        this.line.setToken(strings.Join(this.Values, ", "))
+    }
+
+    if this.section != nil {
+        this.section.changed()
+    }
+
+    return nil
+}
+
 // String prints a more human-readable representation of the IniValue
 // object.
 func (this *IniValue) String() string {
@@ -173,19 +208,51 @@ func (this *IniValue) String() string {
 }
 
 // parseValues strips any line comments from the value string,
-// splits the raw string into its individual comma-separated parts,
-// and trims any enclosing whitespace before adding the array of values
-// to the IniValue object.
-func (this *IniValue) parseValues(valstring string) {
+// expands it using the given function (if not nil), splits the raw
+// string into its individual comma-separated parts, and trims any
+// enclosing whitespace before adding the array of values to the IniValue
+// object. Should expansion fail, the unexpanded values are added and the
+// error is returned.
+func (this *IniValue) parseValues(valstring string, expand func(string) (string, error)) error {
     valstring = stripEOLComment(valstring)
 
+    var err error
+    if expand != nil {
+        var expanded string
+        if expanded, err = expand(valstring); err == nil {
+            valstring = expanded
+        }
+    }
+
+    this.Values = splitValues(valstring)
+
+    return err
+}
+
+// unlink removes the line backing the IniValue from its document and
+// detaches the IniValue from its section.
+func (this *IniValue) unlink() {
+    if this.doc != nil {
+        this.doc.remove(this.line)
+    }
+
+    this.doc     = nil
+    this.line    = nil
+    this.section = nil
+}
+
+// splitValues splits the given value string into its individual
+// comma-separated parts, and trims any enclosing whitespace from each.
+func splitValues(valstring string) []string {
     // parse out delimiters
     valparts := strings.Split(valstring, ",")
-    this.Values = make([]string, len(valparts))
+    values   := make([]string, len(valparts))
 
     for i := range valparts {
-        this.Values[i] = strings.TrimSpace(valparts[i])
+        values[i] = strings.TrimSpace(valparts[i])
     }
+
+    return values
 }
 
 // stripEOLComment strips the comment section of any inline comment
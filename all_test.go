@@ -13,8 +13,17 @@
 package ini
 
 import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io/ioutil"
     "os"
+    "path/filepath"
+    "runtime"
+    "strings"
     "testing"
+    "testing/fstest"
     "time"
 )
 
@@ -68,14 +77,1812 @@ func TestMultiFileIni(t *testing.T) {
 	}
 }
 
-func TestIniMonitor(t *testing.T) {
-    cfg := New("./test.ini")
-    Subscribe(cfg, onCfgChange)
-    err := touch(cfg.Paths[0])
+func TestLoadMissingFile(t *testing.T) {
+    cfg, err := LoadFiles([]string{"./test.ini", "./missing.ini"})
+    if cfg != nil {
+        t.Error("expected a nil config when a file is missing")
+    }
+
+    var perr *ParseError
+    if !errors.As(err, &perr) {
+        t.Fatalf("expected a *ParseError, got %v", err)
+    }
+
+    if perr.Path != "./missing.ini" {
+        t.Errorf("expected ./missing.ini, got %s", perr.Path)
+    }
+
+    if !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("expected error to wrap os.ErrNotExist, got %v", err)
+    }
+
+    if _, err = LoadFiles(nil); err != ErrNoFiles {
+        t.Errorf("expected ErrNoFiles, got %v", err)
+    }
+}
+
+func TestTryReparseKeepsLastGood(t *testing.T) {
+    cfg, err := Load("./test.ini")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ver := cfg.ConfigVer
+    cfg.Paths = []string{"./missing.ini"}
+
+    if err = cfg.TryReparse(); err == nil {
+        t.Fatal("expected an error reparsing a missing file")
+    }
+
+    if cfg.ConfigVer != ver || cfg.GetSection("section_1") == VoidSection {
+        t.Error("expected the last good parse to be retained")
+    }
+}
+
+func TestStrictDiagnostics(t *testing.T) {
+    cfg, err := LoadWithOptions([]string{"./test.ini"}, Options{Strict: true})
+    if cfg != nil {
+        t.Error("expected a nil config in strict mode")
+    }
+
+    derr, ok := err.(*DiagnosticsError)
+    if !ok {
+        t.Fatalf("expected a *DiagnosticsError, got %v", err)
+    }
+
+    if len(derr.Diagnostics) != 3 {
+        t.Fatalf("expected 3 diagnostics, got %d: %v", len(derr.Diagnostics), derr)
+    }
+
+    d := derr.Diagnostics[2]
+    if d.Path != "./test.ini" || d.Line != 3 || d.Column != 2 {
+        t.Errorf("expected ./test.ini:3:2, got %s", d)
+    }
+
+    path := writeTemp(t, "[section\n[ok]\nkey=val\nbogus\n")
+    cfg, err = Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(cfg.Warnings) != 2 || cfg.Warnings[0].Line != 1 || cfg.Warnings[1].Line != 4 {
+        t.Errorf("expected warnings on lines 1 and 4, got %v", cfg.Warnings)
+    }
+
+    if cfg.GetSection("ok").GetFirstVal("key").GetValStr(0, "") != "val" {
+        t.Error("expected lenient mode to keep well-formed lines")
+    }
+}
+
+func TestModifyAndSave(t *testing.T) {
+    cfg, err := LoadFiles([]string{"./test.ini", "./test2.ini"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err = cfg.SetValue("section 1", "key1", "a, b"); err != nil {
+        t.Fatal(err)
+    }
+
+    if err = cfg.SetValue("new section", "key", "val"); err != nil {
+        t.Fatal(err)
+    }
+
+    if err = cfg.RenameSection("section2", "section3"); err != ErrSectionExists {
+        t.Errorf("expected ErrSectionExists, got %v", err)
+    }
+
+    if err = cfg.RenameSection("section2", "renamed"); err != nil {
+        t.Fatal(err)
+    }
+
+    if !cfg.DeleteKey("section_1", "key2") || cfg.DeleteKey("section_1", "key2") {
+        t.Error("expected key2 to be deleted exactly once")
+    }
+
+    if !cfg.DeleteSection("section3") {
+        t.Error("expected section3 to be deleted")
+    }
+
+    if err = cfg.GetSection("renamed").GetFirstVal("newstuff").SetValues("x", "y,z"); err == nil {
+        t.Error("expected an error setting a value containing a comma")
+    }
+
+    if err = cfg.SetValue("bad", "[key", "val"); err == nil {
+        t.Error("expected an error setting an invalid key")
+    }
+
+    for _, key := range []string{"!key", "+key", " +key"} {
+        if err = cfg.SetValue("bad", key, "val"); err == nil {
+            t.Errorf("expected an error setting key %q, which begins with an override marker", key)
+        }
+    }
+
+    path := filepath.Join(t.TempDir(), "saved.ini")
+    if err = cfg.Save(path); err != nil {
+        t.Fatal(err)
+    }
+
+    saved, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if saved.ConfigVer != cfg.ConfigVer {
+        t.Errorf("expected saved config to round trip\n%s\n%s", cfg, saved)
+    }
+
+    if saved.GetSection("section_1").GetFirstVal("key1").GetValStr(1, "") != "b" {
+        t.Error("expected key1 to have been replaced with a, b")
+    }
+
+    if saved.GetSection("section3") != VoidSection || saved.GetSection("renamed") == VoidSection {
+        t.Error("expected section3 to be deleted and section2 to be renamed")
+    }
+}
+
+func TestLosslessEdit(t *testing.T) {
+    raw, err := ioutil.ReadFile("./test.ini")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := Load("./test.ini")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var buf bytes.Buffer
+    if _, err = cfg.WriteTo(&buf); err != nil || buf.String() != string(raw) {
+        t.Fatalf("expected unmodified document to round trip exactly, got\n%s", buf.String())
+    }
+
+    path := writeTemp(t, "; header\r\n[Server]\r\n  Host = example.com   # primary\r\n  Port=80\r\n\r\n# other\r\n[Other]\r\nx = 1")
+    cfg, err = Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cfg.SetValue("server", "port", "8080")
+    cfg.SetValue("server", "timeout", "30")
+    cfg.GetSection("server").GetFirstVal("host").SetValues("example.org")
+    cfg.DeleteSection("other")
+    cfg.SetValue("Extra", "Key", "val")
+
+    if err = cfg.SaveAll(); err != nil {
+        t.Fatal(err)
+    }
+
+    saved, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := "; header\r\n[Server]\r\n  Host = example.org   # primary\r\n  Port=8080\r\n  timeout = 30\r\n\r\n[Extra]\r\nKey = val"
+    if string(saved) != expected {
+        t.Errorf("expected %q, got %q", expected, string(saved))
+    }
+
+    reloaded, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if reloaded.ConfigVer != cfg.ConfigVer {
+        t.Errorf("expected edited document to round trip\n%s\n%s", cfg, reloaded)
+    }
+}
+
+type testDbCfg struct {
+    Host    string
+    Port    int           `ini:"port"`
+    Timeout time.Duration `ini:"timeout"`
+    Ratio   *float32      `ini:"ratio"`
+    Enabled bool          `ini:"enabled"`
+    Hosts   []string      `ini:"hosts"`
+    Routes  [][]uint16    `ini:"route"`
+    Ignored string        `ini:"-"`
+}
+
+type testAppCfg struct {
+    Db      testDbCfg  `ini:"db"`
+    Replica *testDbCfg `ini:"db replica"`
+    Missing *testDbCfg `ini:"missing"`
+}
+
+func TestUnmarshal(t *testing.T) {
+    path := writeTemp(t, `
+[db]
+host = db.local
+port = 5432
+timeout = 30s
+ratio = 0.5
+enabled = true
+hosts = a, b, c
+route = 1, 2
+route = 3
+ignored = nope
+
+[db_replica]
+port = 5433
+`)
+
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var app testAppCfg
+    if err = cfg.Unmarshal(&app); err != nil {
+        t.Fatal(err)
+    }
+
+    db := app.Db
+    if db.Host != "db.local" || db.Port != 5432 || db.Timeout != 30*time.Second ||
+        db.Ratio == nil || *db.Ratio != 0.5 || !db.Enabled || db.Ignored != "" {
+        t.Errorf("unexpected scalar values: %+v", db)
+    }
+
+    if len(db.Hosts) != 3 || db.Hosts[2] != "c" {
+        t.Errorf("expected hosts a, b, c, got %v", db.Hosts)
+    }
+
+    if len(db.Routes) != 2 || len(db.Routes[0]) != 2 || db.Routes[1][0] != 3 {
+        t.Errorf("expected routes [[1 2] [3]], got %v", db.Routes)
+    }
+
+    if app.Replica == nil || app.Replica.Port != 5433 || app.Missing != nil {
+        t.Errorf("unexpected section pointers: %+v %+v", app.Replica, app.Missing)
+    }
+
+    cfg.SetValue("db", "route", "1, x")
+    err = cfg.Unmarshal(&app)
+
+    uerr, ok := err.(*UnmarshalError)
+    if !ok {
+        t.Fatalf("expected an *UnmarshalError, got %v", err)
+    }
+
+    if uerr.Section != "db" || uerr.Key != "route" || uerr.Offset != 1 || uerr.Value != "x" {
+        t.Errorf("unexpected error details: %v", uerr)
+    }
+
+    if err = cfg.Unmarshal(app); err != ErrInvalidTarget {
+        t.Errorf("expected ErrInvalidTarget, got %v", err)
+    }
+}
+
+func TestMarshal(t *testing.T) {
+    type server struct {
+        Port    int           `ini:"port" comment:"listen port"`
+        Timeout time.Duration `ini:"timeout"`
+        Tags    []string      `ini:"tags"`
+    }
+
+    type sample struct {
+        Zeta  server  `ini:"zeta" comment:"written first"`
+        Alpha *server `ini:"alpha"`
+        Skip  *server `ini:"skip"`
+    }
+
+    in := sample{
+        Zeta:  server{Port: 80, Tags: []string{"a", "b"}},
+        Alpha: &server{Timeout: time.Minute},
+    }
+
+    out, err := Marshal(&in)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := "# written first\n[zeta]\n# listen port\nport = 80\ntags = a, b\n\n[alpha]\ntimeout = 1m0s\n"
+    if string(out) != expected {
+        t.Errorf("expected %q, got %q", expected, string(out))
+    }
+
+    out, err = MarshalWithOptions(in, MarshalOptions{EmitDefaults: true, OmitComments: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Contains(out, []byte("[alpha]\nport = 0\n")) || bytes.Contains(out, []byte("#")) {
+        t.Errorf("expected defaults without comments, got %q", string(out))
+    }
+
+    var app testAppCfg
+    app.Db.Hosts = []string{"x", "y"}
+    app.Db.Routes = [][]uint16{{1, 2}, {3}}
+    app.Db.Port = 5432
+
+    cfg, err := MarshalCfg(app, MarshalOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var back testAppCfg
+    if err = cfg.Unmarshal(&back); err != nil {
+        t.Fatal(err)
+    }
+
+    if back.Db.Port != 5432 || len(back.Db.Hosts) != 2 || len(back.Db.Routes) != 2 {
+        t.Errorf("expected marshalled config to round trip, got %+v", back.Db)
+    }
+
+    in.Zeta.Tags = []string{"a,b"}
+    if _, err = Marshal(in); err == nil {
+        t.Error("expected an error marshalling a value containing a comma")
+    }
+
+    type marker struct {
+        Opts struct {
+            X int `ini:"!x"`
+        } `ini:"opts"`
+    }
+
+    var m marker
+    m.Opts.X = 5
+    if _, err = Marshal(m); err == nil {
+        t.Error("expected an error marshalling a key which begins with an override marker")
+    }
+}
+
+func TestDefaultsAndRequired(t *testing.T) {
+    type pool struct {
+        Host    string        `ini:"host" required:"true"`
+        Port    int           `ini:"port" default:"5432"`
+        Timeout time.Duration `ini:"timeout" default:"30s"`
+        Hosts   []string      `ini:"hosts" default:"a, b"`
+        User    string        `ini:"user" required:"true"`
+    }
+
+    type app struct {
+        Db    pool  `ini:"db"`
+        Cache pool  `ini:"cache"`
+        Queue *pool `ini:"queue" required:"true"`
+        Extra *pool `ini:"extra"`
+    }
+
+    cfg, err := Load(writeTemp(t, "[db]\nhost = db.local\nport = 6543\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var out app
+    err = cfg.Unmarshal(&out)
+
+    rerr, ok := err.(*RequiredError)
+    if !ok {
+        t.Fatalf("expected a *RequiredError, got %v", err)
+    }
+
+    expected := "ini: missing required keys: [db] user, [cache] host, [cache] user, [queue]"
+    if rerr.Error() != expected {
+        t.Errorf("expected %q, got %q", expected, rerr.Error())
+    }
+
+    if out.Db.Port != 6543 || out.Db.Timeout != 30*time.Second || len(out.Db.Hosts) != 2 {
+        t.Errorf("expected defaults to be applied to db, got %+v", out.Db)
+    }
+
+    if out.Cache.Port != 5432 || out.Extra != nil {
+        t.Errorf("expected defaults for missing sections, got %+v %+v", out.Cache, out.Extra)
+    }
+
+    sample, err := MarshalWithOptions(app{}, MarshalOptions{EmitDefaults: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !bytes.Contains(sample, []byte("[cache]\nhost = \nport = 5432\ntimeout = 30s\nhosts = a, b\n")) {
+        t.Errorf("expected defaults in sample output, got %q", string(sample))
+    }
+
+    // explicit zero values survive a round trip, rather than becoming defaults
+    type zeroes struct {
+        Db pool `ini:"db"`
+    }
+
+    in := zeroes{Db: pool{Host: "db.local", Timeout: time.Minute, User: "admin"}}
+    cfg, err = MarshalCfg(in, MarshalOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var back zeroes
+    if err = cfg.Unmarshal(&back); err != nil {
+        t.Fatal(err)
+    }
+
+    if back.Db.Port != 0 || back.Db.Timeout != time.Minute || len(back.Db.Hosts) != 2 {
+        t.Errorf("expected the zero port to round trip, got %+v", back.Db)
+    }
+
+    type badDefault struct {
+        Opts struct {
+            Name string `ini:"name" default:"a # b"`
+        } `ini:"opts"`
+    }
+
+    if _, err = MarshalWithOptions(badDefault{}, MarshalOptions{EmitDefaults: true}); err == nil {
+        t.Error("expected an error marshalling a default which cannot be represented")
+    }
+}
+
+type testBoundCfg struct {
+    Db struct {
+        Port int `ini:"port" required:"true"`
+    } `ini:"db"`
+}
+
+func (this *testBoundCfg) Validate() error {
+    if this.Db.Port == 0 {
+        return errors.New("port must be non-zero")
+    }
+
+    return nil
+}
+
+func TestBind(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    b, err := Bind(cfg, &testBoundCfg{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+
+    for i, content := range []string{"[db]\nport = 2\n", "[db]\nport = x\n", "[db]\nport = 0\n"} {
+        rewrite(t, path, content, i+1)
+        ForceUpdate()
+
+        if port := b.Load().(*testBoundCfg).Db.Port; port != 2 {
+            t.Errorf("expected port 2 after reload %d, got %d", i+1, port)
+        }
+
+        if (i == 0) != (b.Err() == nil) {
+            t.Errorf("unexpected error after reload %d: %v", i+1, b.Err())
+        }
+    }
+
+    if _, err = Bind(New(writeTemp(t, "[db]\n")), &testBoundCfg{}); err == nil {
+        t.Error("expected an error binding a config missing a required key")
+    }
+}
+
+func TestBindMissedChange(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    b, err := Bind(cfg, &testBoundCfg{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+
+    // a change published between the initial population and the
+    // subscription arrives with the subscription's first event
+    rewrite(t, path, "[db]\nport = 2\n", 1)
+    next, err := cfg.reload()
+    if err != nil {
+        t.Fatal(err)
+    }
+    b.onChange(next, 0)
+
+    if port := b.Load().(*testBoundCfg).Db.Port; port != 2 {
+        t.Errorf("expected port 2 from the newer snapshot, got %d", port)
+    }
+}
+
+type testPtrBoundCfg struct {
+    Db *struct {
+        Port int `ini:"port"`
+    } `ini:"db"`
+}
+
+func (this *testPtrBoundCfg) Validate() error {
+    if this.Db.Port > 10 {
+        return errors.New("port out of range")
+    }
+
+    return nil
+}
+
+func TestBindPointerSection(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    v := testPtrBoundCfg{}
+    v.Db = &struct {
+        Port int `ini:"port"`
+    }{}
+
+    b, err := Bind(cfg, &v)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+
+    for i, content := range []string{"[db]\nport = 2\n", "[db]\nport = 99\n"} {
+        rewrite(t, path, content, i+1)
+        ForceUpdate()
+
+        if port := b.Load().(*testPtrBoundCfg).Db.Port; port != 2 {
+            t.Errorf("expected port 2 after reload %d, got %d", i+1, port)
+        }
+    }
+
+    if b.Err() == nil {
+        t.Error("expected the out of range port to be rejected")
+    }
+
+    if v.Db.Port != 1 {
+        t.Errorf("expected the bound struct to be left untouched, got port %d", v.Db.Port)
+    }
+}
+
+func TestSnapshot(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 0\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if cfg.Snapshot() != cfg {
+        t.Error("expected the config to be its own snapshot before any changes")
+    }
+
+    id := Subscribe(cfg, func(*IniCfg, int) {})
+    defer Unsubscribe(cfg, id)
+
+    done := make(chan bool)
+    go func() {
+        defer close(done)
+
+        for i := 0; i < 1000; i++ {
+            snap := cfg.Snapshot()
+            if snap.GetSection("db").GetFirstVal("port").GetValInt(0, -1) < 0 {
+                t.Error("observed an incomplete snapshot")
+                return
+            }
+        }
+    }()
+
+    for i := 1; i <= 5; i++ {
+        rewrite(t, path, fmt.Sprintf("[db]\nport = %d\n", i), i)
+        ForceUpdate()
+    }
+    <-done
+
+    snap := cfg.Snapshot()
+    if snap.GetSection("db").GetFirstVal("port").GetValInt(0, 0) != 5 {
+        t.Errorf("expected the latest snapshot to have port 5, got\n%s", snap)
+    }
+
+    if cfg.GetSection("db").GetFirstVal("port").GetValInt(0, -1) != 0 {
+        t.Error("expected the original config to be left untouched")
+    }
+
+    defer func() {
+        if recover() == nil {
+            t.Error("expected modifying a frozen snapshot to panic")
+        }
+    }()
+    snap.SetValue("db", "port", "6")
+}
+
+func TestFileWatcher(t *testing.T) {
+    if runtime.GOOS != "linux" {
+        t.Skip("event driven file watching is only supported on linux")
+    }
+
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    changes := make(chan int, 10)
+    id := Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        if changeCount > 0 {
+            changes <- cfg.GetSection("db").GetFirstVal("port").GetValInt(0, 0)
+        }
+    })
+    defer Unsubscribe(cfg, id)
+
+    // save by renaming a temporary file over the original, as editors do
+    tmpPath := path + ".tmp"
+    rewrite(t, tmpPath, "[db]\nport = 2\n", 1)
+    if err = os.Rename(tmpPath, path); err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case port := <-changes:
+        if port != 2 {
+            t.Errorf("expected port 2, got %d", port)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("change not detected within 2 seconds")
+    }
+}
+
+func TestFileWatcherSymlink(t *testing.T) {
+    if runtime.GOOS != "linux" {
+        t.Skip("event driven file watching is only supported on linux")
+    }
+
+    target := writeTemp(t, "[db]\nport = 1\n")
+    path := filepath.Join(t.TempDir(), "link.ini")
+    if err := os.Symlink(target, path); err != nil {
+        t.Fatal(err)
+    }
+
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // polling is too slow to detect the change within the test
+    mon := NewMonitor(MonitorOptions{PollInterval: time.Hour})
+    mon.Start()
+    defer mon.Stop(context.Background())
+
+    changes := make(chan int, 10)
+    mon.Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        changes <- changeCount
+    })
+    <-changes
+
+    // only the directory containing the target sees the change
+    rewrite(t, target, "[db]\nport = 2\n", 1)
+
+    select {
+    case <-changes:
+    case <-time.After(2 * time.Second):
+        t.Fatal("change to the symlink target not detected within 2 seconds")
+    }
+}
+
+func TestContentChangeDetection(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    changes := 0
+    id := Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        changes = changeCount
+    })
+    defer Unsubscribe(cfg, id)
+
+    // touching the file, or editing only comments, is not a change
+    rewrite(t, path, "[db]\nport = 1\n", 1)
+    ForceUpdate()
+    rewrite(t, path, "# comment\n[db]\nport = 1\n", 2)
+    ForceUpdate()
+
+    if changes != 0 {
+        t.Errorf("expected no notifications, got %d", changes)
+    }
+
+    if cfg.Snapshot().Raws[0] != "# comment\n[db]\nport = 1\n" {
+        t.Error("expected the snapshot to reflect the edited comment")
+    }
+
+    // a real change with an older modification time is detected
+    rewrite(t, path, "[db]\nport = 2\n", -10)
+    ForceUpdate()
+
+    if changes != 1 {
+        t.Errorf("expected 1 notification, got %d", changes)
+    }
+
+    SetNotifyOnRawChange(cfg, true)
+    rewrite(t, path, "[db]\nport = 2 # comment\n", 3)
+    ForceUpdate()
+
+    if changes != 2 {
+        t.Errorf("expected 2 notifications, got %d", changes)
+    }
+}
+
+func TestDiff(t *testing.T) {
+    oldCfg, err := Load(writeTemp(t, "[db]\nhost = a\nport = 1\n[log]\nlevel = info\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    newCfg, err := Load(writeTemp(t, "# comment\n[db]\nhost = a\nport = 2\nuser = x\n[cache]\nsize = 5\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    diff := Diff(oldCfg, newCfg)
+    t.Log(diff)
+
+    if len(diff.Sections) != 3 {
+        t.Fatalf("expected 3 changed sections, got %d", len(diff.Sections))
+    }
+
+    db := diff.Section("db")
+    if db == nil || db.Change != Modified || len(db.Keys) != 2 {
+        t.Fatalf("unexpected [db] diff: %v", db)
+    }
+
+    port := db.Key("port")
+    if port == nil || port.Old[0][0] != "1" || port.New[0][0] != "2" {
+        t.Errorf("unexpected port diff: %v", port)
+    }
+
+    if db.Key("user").Change != Added || db.Key("host") != nil {
+        t.Error("unexpected key diffs in [db]")
+    }
+
+    if diff.Section("cache").Change != Added || diff.Section("log").Change != Removed {
+        t.Error("expected [cache] to be added and [log] removed")
+    }
+
+    if !Diff(newCfg, newCfg).Empty() {
+        t.Error("expected an empty diff between identical configs")
+    }
+}
+
+func TestSubscribeDiff(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n[log]\nlevel = info\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var diffs []*ConfigDiff
+    id := SubscribeDiff(cfg, func(cfg *IniCfg, diff *ConfigDiff) {
+        diffs = append(diffs, diff)
+    })
+    defer Unsubscribe(cfg, id)
+
+    rewrite(t, path, "[db]\nport = 1\n[log]\nlevel = debug\n", 1)
+    ForceUpdate()
+
+    if len(diffs) != 2 {
+        t.Fatalf("expected 2 diffs, got %d", len(diffs))
+    }
+
+    if diffs[0].Section("db").Change != Added {
+        t.Error("expected the initial diff to list [db] as added")
+    }
+
+    if diffs[1].Section("db") != nil || diffs[1].Section("log") == nil {
+        t.Errorf("expected only [log] to change, got:\n%v", diffs[1])
+    }
+}
+
+func TestSubscribeSection(t *testing.T) {
+    path := writeTemp(t, "[db]\nhost = a\nport = 1\n[log]\nlevel = info\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    dbChanges, portChanges := 0, 0
+    id1 := SubscribeSection(cfg, "db", func(cfg *IniCfg, changeCount int) {
+        dbChanges++
+    })
+    defer Unsubscribe(cfg, id1)
+    id2 := SubscribeKey(cfg, "db", "port", func(cfg *IniCfg, changeCount int) {
+        portChanges++
+    })
+    defer Unsubscribe(cfg, id2)
+
+    // unrelated section
+    rewrite(t, path, "[db]\nhost = a\nport = 1\n[log]\nlevel = debug\n", 1)
+    ForceUpdate()
+    // same section, other key
+    rewrite(t, path, "[db]\nhost = b\nport = 1\n[log]\nlevel = debug\n", 2)
+    ForceUpdate()
+    // watched key
+    rewrite(t, path, "[db]\nhost = b\nport = 2\n[log]\nlevel = debug\n", 3)
+    ForceUpdate()
+    // section removed
+    rewrite(t, path, "[log]\nlevel = debug\n", 4)
+    ForceUpdate()
+
+    // each count includes the initial call upon subscription
+    if dbChanges != 4 {
+        t.Errorf("expected 4 [db] notifications, got %d", dbChanges)
+    }
+
+    if portChanges != 3 {
+        t.Errorf("expected 3 port notifications, got %d", portChanges)
+    }
+}
+
+func TestMonitorReleasesConfigs(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    mon := NewMonitor(MonitorOptions{DisableWatcher: true})
+
+    monitored := func() int {
+        mon.lock.Lock()
+        defer mon.lock.Unlock()
+
+        return len(mon.monitors)
+    }
+
+    // queries do not begin monitoring a config
+    mon.LastRejection(cfg)
+    mon.Unsubscribe(cfg, 1)
+    mon.SetValidator(cfg, nil)
+    mon.SetNotifyOnRawChange(cfg, false)
+    if monitored() != 0 {
+        t.Error("expected an unsubscribed config not to be monitored")
+    }
+
+    id := mon.Subscribe(cfg, func(*IniCfg, int) {})
+    mon.Unsubscribe(cfg, id)
+
+    rewrite(t, path, "[db]\nport = 2\n", 1)
+    mon.ForceUpdate()
+
+    if monitored() != 0 || cfg.Snapshot() != cfg {
+        t.Error("expected the config to be released with its last subscriber")
+    }
+
+    // a validator keeps the config monitored until it is removed
+    mon.SetValidator(cfg, func(*IniCfg) error { return nil })
+    id = mon.Subscribe(cfg, func(*IniCfg, int) {})
+    mon.Unsubscribe(cfg, id)
+    if monitored() != 1 {
+        t.Error("expected a config with a validator to remain monitored")
+    }
+
+    mon.SetValidator(cfg, nil)
+    if monitored() != 0 {
+        t.Error("expected the config to be released with its validator")
+    }
+
+    // as does cancelling a subscription's context
+    ctx, cancel := context.WithCancel(context.Background())
+    mon.SubscribeContext(ctx, cfg, func(*IniCfg, int) {})
+    cancel()
+
+    for i := 0; monitored() != 0; i++ {
+        if i == 200 {
+            t.Fatal("expected the config to be released when its context was cancelled")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestSameNamedConfigs(t *testing.T) {
+    var paths [2]string
+    var cfgs [2]*IniCfg
+    var changes [2]int
+
+    for i := range paths {
+        dir := filepath.Join(t.TempDir(), fmt.Sprintf("dir%d", i))
+        if err := os.Mkdir(dir, 0755); err != nil {
+            t.Fatal(err)
+        }
+
+        paths[i] = filepath.Join(dir, "app.ini")
+        if err := ioutil.WriteFile(paths[i], []byte("[db]\nport = 1\n"), 0644); err != nil {
+            t.Fatal(err)
+        }
+
+        cfg, err := Load(paths[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        cfgs[i] = cfg
+
+        index := i
+        id := Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+            changes[index] = changeCount
+        })
+        defer Unsubscribe(cfg, id)
+    }
+
+    rewrite(t, paths[1], "[db]\nport = 2\n", 1)
+    ForceUpdate()
+
+    if changes[0] != 0 || changes[1] != 1 {
+        t.Errorf("expected only the second config to change, got %v", changes)
+    }
+
+    if cfgs[1].Snapshot().GetSection("db").GetFirstVal("port").GetValStr(0, "") != "2" {
+        t.Error("expected the second config to be reloaded")
+    }
+}
+
+func TestAsyncDispatch(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // a blocked subscriber delays neither the monitor nor other subscribers
+    release := make(chan bool)
+    id1 := Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        if changeCount > 0 {
+            <-release
+        }
+    })
+    defer Unsubscribe(cfg, id1)
+
+    // a subscriber may unsubscribe itself without deadlocking
+    var id2 uint32
+    calls := 0
+    id2 = Subscribe(cfg, func(c *IniCfg, changeCount int) {
+        calls++
+        if changeCount > 0 {
+            Unsubscribe(cfg, id2)
+        }
+    })
+
+    ctx, cancel := context.WithCancel(context.Background())
+    events := Watch(ctx, cfg)
+
+    ev := <-events
+    if ev.Type != EventChanged || ev.Old != nil || ev.ChangeCount != 0 {
+        t.Errorf("unexpected initial event: %+v", ev)
+    }
+
+    rewrite(t, path, "[db]\nport = 2\n", 1)
+    go ForceUpdate()
+
+    select {
+    case ev = <-events:
+    case <-time.After(2 * time.Second):
+        t.Fatal("event not received while another subscriber was blocked")
+    }
+
+    if ev.ChangeCount != 1 || ev.Diff().Section("db") == nil {
+        t.Errorf("unexpected change event: %+v", ev)
+    }
+
+    close(release)
+    rewrite(t, path, "[db]\nport = 3\n", 2)
+    ForceUpdate()
+
+    if calls != 2 {
+        t.Errorf("expected 2 calls before unsubscribing, got %d", calls)
+    }
+
+    cancel()
+    for range events {
+    }
+}
+
+func TestForceUpdateUndrainedWatch(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // the channel is never read, so its buffer fills with the initial event
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    Watch(ctx, cfg)
+
+    done := make(chan bool)
+    go func() {
+        defer close(done)
+
+        for i := 1; i <= 3; i++ {
+            rewrite(t, path, fmt.Sprintf("[db]\nport = %d\n", i+1), i)
+            ForceUpdate()
+        }
+    }()
+
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("ForceUpdate blocked on an undrained Watch channel")
+    }
+}
+
+func TestValidator(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := LoadWithOptions([]string{path}, Options{Strict: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    errBadPort := errors.New("bad port")
+    SetValidator(cfg, func(cfg *IniCfg) error {
+        if cfg.GetSection("db").GetFirstVal("port").GetValInt(0, 0) < 1 {
+            return errBadPort
+        }
+        return nil
+    })
+
+    var events []Event
+    id := SubscribeEvents(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+        events = append(events, ev)
+    })
+    defer Unsubscribe(cfg, id)
+
+    // fails validation
+    rewrite(t, path, "[db]\nport = 0\n", 1)
+    ForceUpdate()
+
+    rejected := LastRejection(cfg)
+    if rejected == nil || rejected.Err != errBadPort || rejected.ConfigVer == "" {
+        t.Fatalf("unexpected rejection: %+v", rejected)
+    }
+
+    if cfg.Snapshot().GetSection("db").GetFirstVal("port").GetValInt(0, 0) != 1 {
+        t.Error("expected the last good config to remain published")
+    }
+
+    // fails to parse
+    rewrite(t, path, "[db\nport = 2\n", 2)
+    ForceUpdate()
+
+    var diagErr *DiagnosticsError
+    rejected = LastRejection(cfg)
+    if rejected == nil || !errors.As(rejected.Err, &diagErr) {
+        t.Fatalf("expected a parse failure, got %+v", rejected)
+    }
+
+    if rejected.Cfg == nil || rejected.ConfigVer != rejected.Cfg.ConfigVer || rejected.ConfigVer == "" {
+        t.Errorf("expected the rejected version to be recorded, got %+v", rejected)
+    }
+
+    rewrite(t, path, "[db]\nport = 2\n", 3)
+    ForceUpdate()
+
+    if LastRejection(cfg) != nil {
+        t.Error("expected the rejection to be cleared")
+    }
+
+    if len(events) != 4 ||
+        events[1].Type != EventRejected ||
+        events[1].Err != errBadPort ||
+        events[2].Type != EventRejected ||
+        events[3].Type != EventChanged {
+        t.Errorf("unexpected events: %+v", events)
+    }
+}
+
+func TestMonitorInstances(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    cfg, err := Load(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    monA := NewMonitor(MonitorOptions{
+        DisableWatcher: true,
+        PollInterval:   10 * time.Millisecond,
+    })
+    monB := NewMonitor(MonitorOptions{})
+
+    changes := make(chan int, 10)
+    monA.Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        changes <- changeCount
+    })
+    <-changes
+
+    // a stopped monitor detects nothing until restarted
+    rewrite(t, path, "[db]\nport = 2\n", 1)
+
+    select {
+    case <-changes:
+        t.Fatal("unexpected notification from a stopped monitor")
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    for i := 0; i < 2; i++ {
+        monA.Start()
+
+        select {
+        case <-changes:
+        case <-time.After(2 * time.Second):
+            t.Fatal("change not detected by polling")
+        }
+
+        err = monA.Stop(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        rewrite(t, path, fmt.Sprintf("[db]\nport = %d\n", i+3), i+2)
+    }
+
+    // ForceUpdate works without starting the monitor
+    count := 0
+    monB.Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        count = changeCount
+    })
+
+    rewrite(t, path, "[db]\nport = 9\n", 10)
+    monB.ForceUpdate()
+
+    if count != 1 {
+        t.Errorf("expected 1 change from monB, got %d", count)
+    }
+}
+
+func TestFileLifecycle(t *testing.T) {
+    for _, ignoreMissing := range []bool{false, true} {
+        base := writeTemp(t, "[db]\nport = 1\n")
+        override := writeTemp(t, "[db]\nport = 2\n")
+
+        cfg, err := LoadWithOptions(
+            []string{base, override},
+            Options{IgnoreMissing: ignoreMissing},
+        )
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        var events []Event
+        id := SubscribeEvents(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+            events = append(events, ev)
+        })
+
+        // the value from the last file which defines it
+        port := func() int {
+            vals := cfg.Snapshot().GetSection("db").GetVals("port")
+            return vals[len(vals)-1].GetValInt(0, 0)
+        }
+
+        if err = os.Remove(override); err != nil {
+            t.Fatal(err)
+        }
+        ForceUpdate()
+
+        expected := 2
+        if ignoreMissing {
+            expected = 1
+        }
+
+        if port() != expected {
+            t.Errorf("IgnoreMissing=%t: expected port %d after removal, got %d", ignoreMissing, expected, port())
+        }
+
+        rewrite(t, override, "[db]\nport = 3\n", 1)
+        ForceUpdate()
+
+        if port() != 3 {
+            t.Errorf("IgnoreMissing=%t: expected the reappeared file to be parsed", ignoreMissing)
+        }
+
+        Unsubscribe(cfg, id)
+
+        types := make([]EventType, 0)
+        for i := range events[1:] {
+            types = append(types, events[i+1].Type)
+        }
+
+        expectedTypes := []EventType{EventFileRemoved, EventFileAppeared, EventChanged}
+        if ignoreMissing {
+            expectedTypes = []EventType{EventFileRemoved, EventChanged, EventFileAppeared, EventChanged}
+        }
+
+        if fmt.Sprint(types) != fmt.Sprint(expectedTypes) {
+            t.Errorf("IgnoreMissing=%t: expected events %v, got %v", ignoreMissing, expectedTypes, types)
+        }
+
+        if events[1].Path != override {
+            t.Errorf("expected the removed path to be %s, got %s", override, events[1].Path)
+        }
+    }
+}
+
+func TestMissingLayerKeepsLastContents(t *testing.T) {
+    base := writeTemp(t, "[db]\nhost = localhost\nport = 1\n")
+    override := writeTemp(t, "[db]\nport = 2\n")
+
+    cfg, err := LoadWithOptions([]string{base, override}, Options{})
     if err != nil {
         t.Fatal(err)
     }
-    
+
+    id := Subscribe(cfg, func(*IniCfg, int) {})
+    defer Unsubscribe(cfg, id)
+
+    if err = os.Remove(override); err != nil {
+        t.Fatal(err)
+    }
+    ForceUpdate()
+
+    // edits to the remaining layers are still published, along with the
+    // removed layer's last contents
+    rewrite(t, base, "[db]\nhost = db.example.com\nport = 1\n", 1)
+    ForceUpdate()
+
+    if rejected := LastRejection(cfg); rejected != nil {
+        t.Fatalf("unexpected rejection: %v", rejected.Err)
+    }
+
+    db := cfg.Snapshot().GetSection("db")
+    if db.GetVal("host").GetValStr(0, "") != "db.example.com" || db.GetVal("port").GetValInt(0, 0) != 2 {
+        t.Errorf("unexpected config after editing the remaining layer:\n%s", cfg.Snapshot().RawString())
+    }
+
+    // explicit reparsing still reports the missing file
+    if err = cfg.TryReparse(); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("expected TryReparse to report the missing file, got %v", err)
+    }
+}
+
+func TestParseReader(t *testing.T) {
+    const contents = "[db]\nhost = localhost\nport = 5432\n"
+
+    fromFile, err := Load(writeTemp(t, contents))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cfgs := make([]*IniCfg, 0)
+    for _, parse := range []func() (*IniCfg, error){
+        func() (*IniCfg, error) { return Parse(bytes.NewBufferString(contents), "defaults.ini") },
+        func() (*IniCfg, error) { return ParseBytes([]byte(contents), "defaults.ini") },
+        func() (*IniCfg, error) { return ParseString(contents, "defaults.ini") },
+    } {
+        cfg, err := parse()
+        if err != nil {
+            t.Fatal(err)
+        }
+        cfgs = append(cfgs, cfg)
+    }
+
+    for _, cfg := range cfgs {
+        if cfg.ConfigVer != fromFile.ConfigVer || cfg.Name != "defaults" {
+            t.Errorf("unexpected config %s (%s)", cfg.Name, cfg.ConfigVer)
+        }
+    }
+
+    cfg := cfgs[0]
+    if !strings.Contains(cfg.RawString(), contents) {
+        t.Errorf("expected RawString to contain the parsed content, got:\n%s", cfg.RawString())
+    }
+
+    // reparsing and monitoring leave in-memory configs untouched
+    cfg.Reparse()
+    Subscribe(cfg, func(*IniCfg, int) {})
+    ForceUpdate()
+    ClearSubscribers(cfg)
+
+    if cfg.ConfigVer != fromFile.ConfigVer {
+        t.Error("expected Reparse to reparse the in-memory content")
+    }
+
+    _, err = ParseWithOptions(strings.NewReader("[db\n"), "defaults.ini", Options{Strict: true})
+    if err == nil || !strings.Contains(err.Error(), "defaults.ini:1:1:") {
+        t.Errorf("expected a diagnostic naming the source, got %v", err)
+    }
+}
+
+func TestLoadFS(t *testing.T) {
+    fsys := fstest.MapFS{
+        "conf/defaults.ini": &fstest.MapFile{
+            Data:    []byte("[db]\nhost = localhost\nport = 5432\n"),
+            ModTime: time.Unix(1, 0),
+        },
+    }
+
+    cfg, err := LoadFS(fsys, "conf/defaults.ini")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if cfg.Name != "defaults" || cfg.GetSection("db").GetFirstVal("host").GetValStr(0, "") != "localhost" {
+        t.Errorf("unexpected config:\n%s", cfg)
+    }
+
+    if _, err = LoadFS(fsys, "conf/missing.ini"); err == nil {
+        t.Error("expected an error loading a missing file")
+    }
+
+    // defaults from the FS, overridden on disk
+    override := writeTemp(t, "[db]\nport = 6543\n")
+    layered, err := LoadLayers([]Layer{
+        {FS: fsys, Path: "conf/defaults.ini"},
+        {Path: override},
+    }, Options{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(layered.GetSection("db").GetVals("port")) != 2 {
+        t.Errorf("expected both layers to be merged:\n%s", layered)
+    }
+
+    // the monitor detects changes within the FS
+    mon := NewMonitor(MonitorOptions{DisableWatcher: true})
+    count := 0
+    mon.Subscribe(layered, func(cfg *IniCfg, changeCount int) {
+        count = changeCount
+    })
+
+    fsys["conf/defaults.ini"] = &fstest.MapFile{
+        Data:    []byte("[db]\nhost = db.example.com\nport = 5432\n"),
+        ModTime: time.Unix(2, 0),
+    }
+    mon.ForceUpdate()
+
+    host := layered.Snapshot().GetSection("db").GetFirstVal("host").GetValStr(0, "")
+    if count != 1 || host != "db.example.com" {
+        t.Errorf("expected the FS change to be published, got %d changes, host %s", count, host)
+    }
+}
+
+func TestPollFSWithWatcher(t *testing.T) {
+    path := writeTemp(t, "[db]\nport = 1\n")
+    fsys := os.DirFS(filepath.Dir(path))
+
+    cfg, err := LoadFS(fsys, filepath.Base(path))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // files within an FS are never watched, so they must be polled even
+    // while the watcher is healthy
+    mon := NewMonitor(MonitorOptions{PollInterval: 10 * time.Millisecond})
+    mon.Start()
+    defer mon.Stop(context.Background())
+
+    changes := make(chan int, 10)
+    mon.Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        changes <- changeCount
+    })
+    <-changes
+
+    rewrite(t, path, "[db]\nport = 2\n", 1)
+
+    select {
+    case <-changes:
+    case <-time.After(2 * time.Second):
+        t.Fatal("change within the FS not detected")
+    }
+}
+
+func TestMergeStrategies(t *testing.T) {
+    base := writeTemp(t, "[db]\nhost = base\nport = 1\nport = 2\nuser = admin\n")
+    override := writeTemp(t, "[db]\nhost = override\nport = 3\n!user = app\n")
+    paths := []string{base, override}
+
+    get := func(cfg *IniCfg, key string) string {
+        vals := make([]string, 0)
+        for _, val := range cfg.GetSection("db").GetVals(key) {
+            vals = append(vals, val.GetValStr(0, ""))
+        }
+        return strings.Join(vals, ",") + " " + cfg.GetSection("db").GetVal(key).GetValStr(0, "")
+    }
+
+    expected := map[MergeStrategy][3]string{
+        MergeAppend:    {"base,override override", "1,2,3 3", "app app"},
+        MergeOverride:  {"override override", "3 3", "app app"},
+        MergeFirstWins: {"base base", "1,2 1", "app app"},
+    }
+
+    for strategy, want := range expected {
+        cfg, err := LoadWithOptions(paths, Options{Merge: strategy})
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        for i, key := range []string{"host", "port", "user"} {
+            if got := get(cfg, key); got != want[i] {
+                t.Errorf("strategy %d, key %s: expected %q, got %q", strategy, key, want[i], got)
+            }
+        }
+    }
+
+    _, err := LoadWithOptions(paths, Options{Merge: MergeError})
+
+    var diagErr *DiagnosticsError
+    if !errors.As(err, &diagErr) || len(diagErr.Diagnostics) != 2 {
+        t.Fatalf("expected conflicts for host and port, got %v", err)
+    }
+
+    t.Log(err)
+}
+
+func TestUnmarshalLayers(t *testing.T) {
+    base := writeTemp(t, "[db]\nhost = base\nports = 1,2\n")
+    override := writeTemp(t, "[db]\nhost = override\nports = 3\n")
+    paths := []string{base, override}
+
+    type dbCfg struct {
+        Host  string `ini:"host"`
+        Ports []int  `ini:"ports"`
+    }
+
+    type layeredCfg struct {
+        Db dbCfg `ini:"db"`
+    }
+
+    expected := map[MergeStrategy]string{
+        MergeAppend:    "override [3]",
+        MergeOverride:  "override [3]",
+        MergeFirstWins: "base [1 2]",
+    }
+
+    for strategy, want := range expected {
+        cfg, err := LoadWithOptions(paths, Options{Merge: strategy})
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        var v layeredCfg
+        if err = cfg.Unmarshal(&v); err != nil {
+            t.Fatal(err)
+        }
+
+        if got := fmt.Sprintf("%s %v", v.Db.Host, v.Db.Ports); got != want {
+            t.Errorf("strategy %d: expected %q, got %q", strategy, want, got)
+        }
+
+        if got := cfg.GetSection("db").GetVal("host").GetValStr(0, ""); got != v.Db.Host {
+            t.Errorf("strategy %d: Unmarshal disagrees with GetVal (%q)", strategy, got)
+        }
+    }
+}
+
+func TestProvenance(t *testing.T) {
+    base := writeTemp(t, "[db]\nhost = base\nport = 1\n")
+    override := writeTemp(t, "# overrides\n[db]\nport = 2\n")
+
+    cfg, err := LoadWithOptions([]string{base, override}, Options{Merge: MergeOverride})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    src := cfg.GetSection("db").GetVal("port").Source()
+    if src.Path != override || src.Line != 3 || src.Layer != 1 {
+        t.Errorf("unexpected source for port: %+v", src)
+    }
+
+    if VoidValue.Source().Layer != -1 {
+        t.Error("expected VoidValue to have no layer")
+    }
+
+    explanation := cfg.Explain("db", "port")
+    t.Log(explanation)
+
+    defs := explanation.Definitions
+    if len(defs) != 2 ||
+        defs[0].Active || defs[0].Source.Layer != 0 || defs[0].Values[0] != "1" ||
+        !defs[1].Winner || defs[1].Source.Layer != 1 {
+        t.Errorf("unexpected explanation:\n%s", explanation)
+    }
+
+    if len(cfg.Explain("db", "missing").Definitions) != 0 {
+        t.Error("expected no definitions for a missing key")
+    }
+}
+
+func TestIncludes(t *testing.T) {
+    dir := t.TempDir()
+    files := map[string]string{
+        "app.ini":           "include = app.d/*.ini\n!include extra.ini\n[db]\nhost = base\n",
+        "app.d/20-b.ini":    "[db]\nport = 2\n",
+        "app.d/10-a.ini":    "!include ../extra.ini\n[db]\nhost = a\n",
+        "extra.ini":         "[log]\nlevel = info\n",
+        "cycle/a.ini":       "!include b.ini\n",
+        "cycle/b.ini":       "[db]\n!include a.ini\n",
+        "conf/main.ini":     "!includedir conf.d\n",
+        "conf/conf.d/x.ini": "[x]\nkey = 1\n",
+        "conf/conf.d/y.txt": "[y]\nkey = 1\n",
+        "self/app.ini":      "!include *.ini\n[db]\nhost = app\n",
+        "self/other.ini":    "[db]\nport = 1\n",
+        "selfdir/app.ini":   "!includedir .\n",
+        "selfdir/b.ini":     "[b]\nkey = 1\n",
+    }
+
+    for name, contents := range files {
+        filePath := filepath.Join(dir, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    cfg, err := LoadWithOptions(
+        []string{filepath.Join(dir, "app.ini")},
+        Options{Merge: MergeOverride, Strict: true},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // included files follow their includer, depth first and in lexical
+    // order, and files already included are skipped
+    expected := []string{"app.ini", "app.d/10-a.ini", "extra.ini", "app.d/20-b.ini"}
+    if len(cfg.Paths) != len(expected) {
+        t.Fatalf("expected paths %v, got %v", expected, cfg.Paths)
+    }
+    for i := range expected {
+        if cfg.Paths[i] != filepath.Join(dir, filepath.FromSlash(expected[i])) {
+            t.Errorf("expected path %d to be %s, got %s", i, expected[i], cfg.Paths[i])
+        }
+    }
+
+    db := cfg.GetSection("db")
+    if db.GetVal("host").GetValStr(0, "") != "a" || db.GetVal("port").GetValInt(0, 0) != 2 {
+        t.Errorf("unexpected [db] section:\n%s", db)
+    }
+
+    if cfg.GetSection("log") == VoidSection {
+        t.Error("expected [log] from the nested include")
+    }
+
+    conf, err := Load(filepath.Join(dir, "conf", "main.ini"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(conf.Paths) != 2 || conf.GetSection("x") == VoidSection {
+        t.Errorf("expected only the .ini file to be included, got %v", conf.Paths)
+    }
+
+    _, err = Load(filepath.Join(dir, "cycle", "a.ini"))
+    var perr *ParseError
+    if !errors.Is(err, ErrIncludeCycle) || !errors.As(err, &perr) ||
+        filepath.Base(perr.Path) != "b.ini" || perr.Line != 2 {
+        t.Errorf("expected a cycle at b.ini:2, got %v", err)
+    }
+
+    // globs and included directories may match the including file
+    for _, name := range []string{"self/app.ini", "selfdir/app.ini"} {
+        self, err := Load(filepath.Join(dir, filepath.FromSlash(name)))
+        if err != nil || len(self.Paths) != 2 {
+            t.Errorf("expected %s to be loaded once alongside its sibling, got %v", name, err)
+        }
+    }
+
+    mem, err := ParseString("!include other.ini\n[db]\nhost = a\n", "mem")
+    if err != nil || len(mem.Warnings) != 1 {
+        t.Errorf("expected a warning for an include in memory, got %v", err)
+    }
+
+    // include directives within sections are ordinary keys
+    inSection, err := ParseString("[db]\ninclude = a.ini\n", "mem")
+    if err != nil || inSection.GetSection("db").GetVal("include").GetValStr(0, "") != "a.ini" {
+        t.Errorf("expected include to be an ordinary key within a section, got %v", err)
+    }
+
+    // the monitor watches included files and picks up new snippets
+    mon := NewMonitor(MonitorOptions{PollInterval: time.Hour})
+    mon.Start()
+    defer mon.Stop(context.Background())
+
+    changes := make(chan *IniCfg, 10)
+    mon.Subscribe(cfg, func(cfg *IniCfg, changeCount int) {
+        changes <- cfg
+    })
+    <-changes
+
+    waitFor := func(what string) *IniCfg {
+        select {
+        case next := <-changes:
+            return next
+        case <-time.After(5 * time.Second):
+            mon.ForceUpdate()
+        }
+
+        select {
+        case next := <-changes:
+            if runtime.GOOS == "linux" {
+                t.Errorf("expected the watcher to detect %s", what)
+            }
+            return next
+        default:
+            t.Fatalf("%s was not detected", what)
+        }
+
+        return nil
+    }
+
+    snippet := filepath.Join(dir, "app.d", "30-c.ini")
+    err = ioutil.WriteFile(snippet, []byte("[db]\nhost = c\n"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    next := waitFor("the new snippet")
+    if next.GetSection("db").GetVal("host").GetValStr(0, "") != "c" || len(next.Paths) != 5 {
+        t.Errorf("expected the new snippet to be included, got %v", next.Paths)
+    }
+
+    rewrite(t, snippet, "[db]\nhost = d\n", 1)
+
+    next = waitFor("the change to the new snippet")
+    if next.GetSection("db").GetVal("host").GetValStr(0, "") != "d" {
+        t.Errorf("expected the change to the snippet to be published:\n%s", next)
+    }
+
+    if err = os.Remove(snippet); err != nil {
+        t.Fatal(err)
+    }
+
+    next = waitFor("the removed snippet")
+    if next.GetSection("db").GetVal("host").GetValStr(0, "") != "a" {
+        t.Errorf("expected the removed snippet's values to be dropped:\n%s", next)
+    }
+}
+
+func TestExpandEnv(t *testing.T) {
+    os.Setenv("INI_TEST_HOST", "db.example.com")
+    os.Setenv("INI_TEST_EMPTY", "")
+    os.Unsetenv("INI_TEST_UNSET")
+    defer os.Unsetenv("INI_TEST_HOST")
+    defer os.Unsetenv("INI_TEST_EMPTY")
+
+    contents := "[db]\n" +
+        "host = ${INI_TEST_HOST} # comment\n" +
+        "port = ${INI_TEST_UNSET:-5432}\n" +
+        "user = ${INI_TEST_EMPTY:-admin}\n" +
+        "pass = $$ecret, $5\n" +
+        "url = tcp://${INI_TEST_HOST}:${INI_TEST_UNSET:-5432}/x\n"
+
+    cfg, err := ParseWithOptions(strings.NewReader(contents), "env", Options{ExpandEnv: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    db := cfg.GetSection("db")
+    expected := map[string]string{
+        "host": "db.example.com",
+        "port": "5432",
+        "user": "admin",
+        "pass": "$ecret",
+        "url":  "tcp://db.example.com:5432/x",
+    }
+
+    for key, val := range expected {
+        if db.GetVal(key).GetValStr(0, "") != val {
+            t.Errorf("expected %s to be %q, got %q", key, val, db.GetVal(key).Values)
+        }
+    }
+
+    if db.GetVal("pass").GetValStr(1, "") != "$5" {
+        t.Errorf("expected a lone $ to be kept, got %q", db.GetVal("pass").Values)
+    }
+
+    // the document retains the references
+    if !strings.Contains(cfg.Documents()[0].String(), "${INI_TEST_HOST}") {
+        t.Error("expected the document to be left unexpanded")
+    }
+
+    // expansion is opt in
+    plain, err := ParseString(contents, "env")
+    if err != nil || plain.GetSection("db").GetVal("host").GetValStr(0, "") != "${INI_TEST_HOST}" {
+        t.Errorf("expected values to be left unexpanded by default, got %v", err)
+    }
+
+    // unset variables expand to nothing, unless StrictEnv is set
+    unset := "[db]\nhost = ${INI_TEST_UNSET}\n"
+    lax, err := ParseWithOptions(strings.NewReader(unset), "env", Options{ExpandEnv: true})
+    if err != nil || lax.GetSection("db").GetVal("host").GetValStr(0, "none") != "none" {
+        t.Errorf("expected an unset variable to expand to nothing, got %v", err)
+    }
+
+    _, err = ParseWithOptions(
+        strings.NewReader(unset),
+        "env",
+        Options{ExpandEnv: true, StrictEnv: true},
+    )
+
+    var derr *DiagnosticsError
+    if !errors.As(err, &derr) ||
+        derr.Diagnostics[0].Line != 2 ||
+        !strings.Contains(derr.Diagnostics[0].Message, "INI_TEST_UNSET") {
+        t.Errorf("expected a diagnostic for the unset variable, got %v", err)
+    }
+}
+
+func TestInterpolation(t *testing.T) {
+    base := writeTemp(t, "[server]\n"+
+        "base_url = https://${host}:${port}\n"+
+        "host = example.com\n"+
+        "port = 80\n"+
+        "[api]\n"+
+        "users = ${server.base_url}/users # comment\n"+
+        "ports = ${server.port}, ${timeout:-30}\n"+
+        "literal = $${server.host}\n"+
+        "[my.app]\n"+
+        "name = app\n"+
+        "[log]\n"+
+        "file = /var/log/${my.app.name}.log\n")
+    override := writeTemp(t, "[server]\nport = 8080\n")
+
+    cfg, err := LoadWithOptions(
+        []string{base, override},
+        Options{Interpolate: true, Merge: MergeOverride},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // references are resolved after the files are merged
+    api := cfg.GetSection("api")
+    if api.GetVal("users").GetValStr(0, "") != "https://example.com:8080/users" {
+        t.Errorf("unexpected users value %q", api.GetVal("users").Values)
+    }
+
+    ports := api.GetVal("ports")
+    if len(ports.Values) != 2 || ports.GetValInt(0, 0) != 8080 || ports.GetValInt(1, 0) != 30 {
+        t.Errorf("unexpected ports value %q", ports.Values)
+    }
+
+    if api.GetVal("literal").GetValStr(0, "") != "${server.host}" {
+        t.Errorf("expected an escaped reference to be kept, got %q", api.GetVal("literal").Values)
+    }
+
+    if cfg.GetSection("log").GetVal("file").GetValStr(0, "") != "/var/log/app.log" {
+        t.Errorf("expected a reference to a dotted section, got %q", cfg.GetSection("log").GetVal("file").Values)
+    }
+
+    // cycles and undefined references point at the offending line
+    _, err = ParseWithOptions(
+        strings.NewReader("[a]\nx = ${y}\ny = ${a.x}\nz = ${nope}\n"),
+        "refs",
+        Options{Interpolate: true},
+    )
+
+    var derr *DiagnosticsError
+    if !errors.As(err, &derr) || len(derr.Diagnostics) != 2 {
+        t.Fatalf("expected two diagnostics, got %v", err)
+    }
+
+    if derr.Diagnostics[0].Line != 3 || !strings.Contains(derr.Diagnostics[0].Message, "a.x -> a.y -> a.x") {
+        t.Errorf("unexpected cycle diagnostic: %s", derr.Diagnostics[0])
+    }
+
+    if derr.Diagnostics[1].Line != 4 || !strings.Contains(derr.Diagnostics[1].Message, "nope") {
+        t.Errorf("unexpected undefined reference diagnostic: %s", derr.Diagnostics[1])
+    }
+
+    // with ExpandEnv, references fall back to the environment
+    os.Setenv("INI_TEST_HOST", "db.example.com")
+    defer os.Unsetenv("INI_TEST_HOST")
+
+    env, err := ParseWithOptions(
+        strings.NewReader("[db]\nhost = ${INI_TEST_HOST}\nurl = tcp://${host}/${nope}\n"),
+        "env",
+        Options{ExpandEnv: true, Interpolate: true},
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if env.GetSection("db").GetVal("url").GetValStr(0, "") != "tcp://db.example.com/" {
+        t.Errorf("unexpected url value %q", env.GetSection("db").GetVal("url").Values)
+    }
+}
+
+func TestIniMonitor(t *testing.T) {
+    path := copyFixture(t, "./test.ini")
+    cfg := New(path)
+    id := Subscribe(cfg, onCfgChange)
+    defer Unsubscribe(cfg, id)
+
+    // touching the file is not a change; rewriting its content is
+    rewrite(t, path, cfg.Raws[0] + "\n[monitor]\nchanged = true\n", 1)
+
     select {
     case <-stopTest:
         t.Log("Config change notified successfully")
@@ -85,13 +1892,13 @@ func TestIniMonitor(t *testing.T) {
 }
 
 func TestIniMonitorOnSecondFile(t *testing.T) {
-    cfg := newIniCfgFromFiles([]string{"./test.ini", "./test2.ini"})
-    Subscribe(cfg, onCfgChange)
-    err := touch(cfg.Paths[1])
-    if err != nil {
-        t.Fatal(err)
-    }
-    
+    paths := []string{copyFixture(t, "./test.ini"), copyFixture(t, "./test2.ini")}
+    cfg := newIniCfgFromFiles(paths)
+    id := Subscribe(cfg, onCfgChange)
+    defer Unsubscribe(cfg, id)
+
+    rewrite(t, paths[1], cfg.Raws[1] + "\n[monitor]\nchanged = true\n", 1)
+
     select {
     case <-stopTest:
         t.Log("Config change notified successfully")
@@ -101,10 +1908,54 @@ func TestIniMonitorOnSecondFile(t *testing.T) {
 }
 
 func onCfgChange(cfg *IniCfg, changeCount int) {
-    stopTest<- true
+    if changeCount > 0 {
+        stopTest<- true
+    }
 }
 
 func touch(path string) error {
     now := time.Now()
     return os.Chtimes(path, now, now)
 }
+
+var tempCount int
+
+func writeTemp(t *testing.T, contents string) string {
+    tempCount++
+    path := filepath.Join(t.TempDir(), fmt.Sprintf("temp%d.ini", tempCount))
+    err := ioutil.WriteFile(path, []byte(contents), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return path
+}
+
+func copyFixture(t *testing.T, path string) string {
+    contents, err := ioutil.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return writeTemp(t, string(contents))
+}
+
+func rewrite(t *testing.T, path, contents string, generation int) {
+    // replace the file atomically, so that a check triggered by the
+    // watcher never observes it half written
+    tmpPath := path + ".tmp"
+    err := ioutil.WriteFile(tmpPath, []byte(contents), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // make sure the change is visible regardless of timestamp granularity
+    mtime := time.Now().Add(time.Duration(generation) * time.Second)
+    if err = os.Chtimes(tmpPath, mtime, mtime); err != nil {
+        t.Fatal(err)
+    }
+
+    if err = os.Rename(tmpPath, path); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -1,11 +1,10 @@
 module github.com/xaevman/ini
 
-go 1.12
+go 1.16
 
 require (
 	github.com/mitchellh/go-ps v0.0.0-20170309133038-4fdf99ab2936 // indirect
 	github.com/xaevman/app v0.0.0-20190208024703-544c5d335566 // indirect
 	github.com/xaevman/crash v0.0.0-20160116021402-4f12454dac5a
-	github.com/xaevman/shutdown v0.0.0-20170619171835-a5f6f007ccad
 	github.com/xaevman/str v0.0.0-20160101053501-4e092892a36f // indirect
 )
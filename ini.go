@@ -12,15 +12,36 @@
 
 // Package ini provides basic facilities for parsing and monitoring
 // changes to ini format configuration files.
+//
+// A file may pull in other files with an include directive, written either
+// as "!include path" anywhere in the file, or as "include = path" before the
+// first section header. Relative paths are resolved against the directory of
+// the including file, and may contain glob patterns (ex: app.d/*.ini), whose
+// matches are included in lexical order. "includedir" (or "!includedir")
+// includes every .ini file within the given directory. Included files are
+// layered immediately after the file which includes them, as though they had
+// been listed after it in the call to NewFromFiles, and are merged according
+// to the config's MergeStrategy. A file which is already part of the config is
+// not included again, even if it is matched by a glob pattern or included
+// directory, but a file which (directly or indirectly) names itself in an
+// include directive causes loading to fail with ErrIncludeCycle. The ini
+// monitor watches included files, along with any directories matched by a
+// glob, so that newly added files are picked up.
 package ini
 
 import (
-	"github.com/xaevman/crash"
-	"github.com/xaevman/shutdown"
-
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,13 +56,92 @@ const sectionRegexFmt = "^\\s*\\[(.*)\\]\\s*$"
 // Regex to parse key/value lines.
 const keyvalRegexFmt = "^\\s*(.*?)\\s*=\\s*(.*?)\\s*$"
 
+// Regex to parse include directives.
+const includeRegexFmt = "^!(include|includedir)(\\s[^=]*)?$"
+
 // Shared regexp objects.
 var (
-	secRegexp    = regexp.MustCompile(sectionRegexFmt)
-	keyvalRegexp = regexp.MustCompile(keyvalRegexFmt)
+	secRegexp     = regexp.MustCompile(sectionRegexFmt)
+	keyvalRegexp  = regexp.MustCompile(keyvalRegexFmt)
+	includeRegexp = regexp.MustCompile(includeRegexFmt)
 )
 
-var iniShutdown = shutdown.New()
+// MergeStrategy determines how instances of a key defined by more than one of
+// a config's files are combined.
+type MergeStrategy int
+
+// Supported merge strategies.
+const (
+	// MergeAppend keeps the instances from every file, in file order.
+	// This is the default.
+	MergeAppend MergeStrategy = iota
+
+	// MergeOverride discards the instances from earlier files in favor of
+	// those from the last file to define the key.
+	MergeOverride
+
+	// MergeFirstWins keeps only the instances from the first file to
+	// define the key.
+	MergeFirstWins
+
+	// MergeError treats a key defined by more than one file as an error.
+	MergeError
+)
+
+// Options controls how ini files are parsed by LoadWithOptions.
+//
+// When Strict is set, any line which cannot be understood by the parser (see
+// Diagnostic) causes loading to fail with a *DiagnosticsError. Otherwise such
+// lines are skipped and recorded in the Warnings field of the resulting IniCfg.
+//
+// When IgnoreMissing is set, files which do not exist are treated as empty,
+// rather than causing loading to fail. The monitor then drops the values of a
+// file which is deleted, and picks up its values if it later reappears;
+// otherwise the file's last good contents continue to be used, even as other
+// files change, until it is restored.
+//
+// Merge selects how keys defined by more than one file are combined. The
+// strategy may be overridden for an individual key by prefixing it with a
+// marker: "!key = value" discards the instances from earlier files, as per
+// MergeOverride, and "+key = value" appends to them, as per MergeAppend.
+// Under MergeError, loading fails with a *DiagnosticsError listing every
+// conflicting key.
+//
+// When ExpandEnv is set, references to environment variables within values,
+// written as ${NAME} or ${NAME:-default}, are replaced with the variable's
+// value, or with the default if the variable is unset or empty. Unset
+// variables without a default expand to nothing, unless StrictEnv is also
+// set, in which case loading fails with a *DiagnosticsError identifying each
+// offending line. "$$" produces a literal "$". Values are expanded before
+// being split on commas, so that a variable may supply a list. Section names
+// and keys are never expanded, and changes to the environment are not
+// detected by the ini monitor.
+//
+// When Interpolate is set, values may refer to other keys, once all of the
+// config's files have been merged: ${section.key} is replaced with the value
+// of key within the named section, and ${key} with that of key within the same
+// section, as returned by IniSection.GetVal. Multiple values are joined with
+// ", ", and a default may be given as for environment variables. If ExpandEnv
+// is also set, references which do not name a key fall back to the
+// environment; keys take precedence. Otherwise, and under StrictEnv, a
+// reference to an undefined key, or a cycle of references, causes loading to
+// fail with a *DiagnosticsError identifying the offending line.
+type Options struct {
+	ExpandEnv     bool
+	IgnoreMissing bool
+	Interpolate   bool
+	Merge         MergeStrategy
+	Strict        bool
+	StrictEnv     bool
+}
+
+// Layer identifies one of the files making up a config loaded by LoadLayers.
+// Path is read from FS, or from the operating system's file system if FS is
+// nil.
+type Layer struct {
+	FS   fs.FS
+	Path string
+}
 
 // IniCfg represents a single virtual ini configuration file, containing pointers
 // to the IniSections contained within it. ConfigVer is a consistent hash
@@ -51,7 +151,9 @@ type IniCfg struct {
 	ConfigVer string
 	Name      string
 
-	// Paths is the set of all ini file paths contributing to the configuration.
+	// Paths is the set of all ini file paths contributing to the configuration,
+	// including those pulled in by include directives, each of which follows
+	// the file that included it.
 	// ModTimes are the corresponding modification times of each of those files.
 	// Raws are the similarly corresponding raw content of those files.
 	Paths     []string
@@ -59,7 +161,28 @@ type IniCfg struct {
 	Raws      []string
 
 	Sections  map[string]*IniSection
-	keys []string
+
+	// Warnings lists every line that was skipped by the parser because it
+	// could not be understood, in file and line order.
+	Warnings []Diagnostic
+
+	docs      []*IniDocument
+	errs      []Diagnostic
+	frozen    bool
+	fsys      []fs.FS
+	globs     []includeGlob
+	inMemory  bool
+	included  []bool
+	keys      []string
+	last      *IniCfg
+	live      *liveCfg
+	opts      Options
+}
+
+// liveCfg holds the most recently published snapshot of an IniCfg. It is
+// shared between an IniCfg and all of the snapshots derived from it.
+type liveCfg struct {
+	cur atomic.Value
 }
 
 // IniSection represents a section within an ini file. Section names are
@@ -77,6 +200,7 @@ type IniSection struct {
 	Name      string
 	Values    map[string][]*IniValue
 
+	cfg  *IniCfg
 	keys []string
 }
 
@@ -88,6 +212,10 @@ type IniSection struct {
 type IniValue struct {
 	Name   string
 	Values []string
+
+	doc     *IniDocument
+	line    *IniLine
+	section *IniSection
 }
 
 // New returns a pointer to a new IniCfg object for the given file path.
@@ -96,15 +224,127 @@ func New(iniPath string) *IniCfg {
 }
 
 // NewFromFiles returns a pointer to a new IniCfg object for the files at the given paths.
+// Keys defined by more than one file are merged using the MergeAppend strategy.
 func NewFromFiles(iniFiles []string) *IniCfg {
 	return newIniCfgFromFiles(iniFiles)
 }
 
-func Shutdown() {
-	iniShutdown.Start()
-	if iniShutdown.WaitForTimeout() {
-		panic("Shutdown Timeout")
+// Load returns a pointer to a new IniCfg object for the given file path. Unlike
+// New, any error encountered while opening or reading the file is returned to
+// the caller as a *ParseError rather than producing an empty configuration.
+func Load(iniPath string) (*IniCfg, error) {
+	return LoadFiles([]string{iniPath})
+}
+
+// LoadFiles returns a pointer to a new IniCfg object for the files at the given
+// paths, merged in the same manner as NewFromFiles. The first error encountered
+// while opening or reading any of the files is returned as a *ParseError, and
+// ErrNoFiles is returned if iniFiles is empty.
+func LoadFiles(iniFiles []string) (*IniCfg, error) {
+	return LoadWithOptions(iniFiles, Options{})
+}
+
+// LoadWithOptions behaves like LoadFiles, parsing the files according to the
+// given Options. In strict mode, a *DiagnosticsError listing every malformed
+// line is returned if any were found. The options are retained by the IniCfg
+// and used again whenever it is reparsed.
+func LoadWithOptions(iniFiles []string, opts Options) (*IniCfg, error) {
+	if len(iniFiles) == 0 {
+		return nil, ErrNoFiles
+	}
+
+	cfg := allocIniCfg(iniFiles)
+	cfg.opts = opts
+
+	err := cfg.TryReparse()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadFS returns a pointer to a new IniCfg object for the files at the given
+// paths within fsys, merged in the same manner as NewFromFiles. Paths are
+// interpreted as described by fs.FS. Errors are reported as by LoadFiles.
+func LoadFS(fsys fs.FS, iniFiles ...string) (*IniCfg, error) {
+	layers := make([]Layer, len(iniFiles))
+	for i := range iniFiles {
+		layers[i] = Layer{FS: fsys, Path: iniFiles[i]}
 	}
+
+	return LoadLayers(layers, Options{})
+}
+
+// LoadLayers behaves like LoadWithOptions, but each file may be read from a
+// different file system, so that, for example, defaults embedded in the
+// binary may be overridden by files on disk. Files read from an fs.FS are
+// monitored for changes by polling, and are not written by SaveAll.
+func LoadLayers(layers []Layer, opts Options) (*IniCfg, error) {
+	if len(layers) == 0 {
+		return nil, ErrNoFiles
+	}
+
+	iniFiles := make([]string, len(layers))
+	for i := range layers {
+		iniFiles[i] = layers[i].Path
+	}
+
+	cfg := allocIniCfg(iniFiles)
+	cfg.fsys = make([]fs.FS, len(layers))
+	cfg.opts = opts
+
+	for i := range layers {
+		cfg.fsys[i] = layers[i].FS
+	}
+
+	err := cfg.TryReparse()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Parse returns a pointer to a new IniCfg object parsed from the content of r,
+// with the same section and value model as one loaded from a file. The name
+// stands in for a file path: it is used to name the config, and appears in
+// Paths and in any diagnostics. Configs parsed from memory are never
+// monitored for changes, and are not written by SaveAll. An error reading r is
+// returned as a *ParseError.
+func Parse(r io.Reader, name string) (*IniCfg, error) {
+	return ParseWithOptions(r, name, Options{})
+}
+
+// ParseBytes behaves like Parse, reading the config from the given bytes.
+func ParseBytes(content []byte, name string) (*IniCfg, error) {
+	return ParseWithOptions(bytes.NewReader(content), name, Options{})
+}
+
+// ParseString behaves like Parse, reading the config from the given string.
+func ParseString(content, name string) (*IniCfg, error) {
+	return ParseWithOptions(strings.NewReader(content), name, Options{})
+}
+
+// ParseWithOptions behaves like Parse, parsing the config according to the
+// given Options.
+func ParseWithOptions(r io.Reader, name string, opts Options) (*IniCfg, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &ParseError{Path: name, Err: err}
+	}
+
+	cfg := allocIniCfg([]string{name})
+	cfg.inMemory = true
+	cfg.opts = opts
+	cfg.Raws[0] = string(content)
+
+	err = cfg.TryReparse()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
 }
 
 // newIniCfg returns a pointer to a new IniCfg object for the given file path.
@@ -114,7 +354,8 @@ func newIniCfg(iniPath string) *IniCfg {
 
 // newIniCfgFromFiles returns a pointer to a new IniCfg object for the files at the given path.
 // Values from multiple files are merged together so that the resulting IniCfg appears to be a single
-// construct. Values from later files overwrite those from earlier files.
+// construct. Instances of a key from later files are appended to those from earlier files
+// (see MergeAppend), so that GetFirstVal returns the earliest and GetVal the latest.
 //
 // This function returns nil if an empty array of paths is provided.
 func newIniCfgFromFiles(iniFiles []string) *IniCfg {
@@ -122,6 +363,15 @@ func newIniCfgFromFiles(iniFiles []string) *IniCfg {
 		return nil
 	}
 
+	cfg := allocIniCfg(iniFiles)
+	cfg.Reparse()
+
+	return cfg
+}
+
+// allocIniCfg returns a pointer to a new, unparsed IniCfg object for the
+// files at the given paths. The config is named after the first file.
+func allocIniCfg(iniFiles []string) *IniCfg {
 	primaryFile := iniFiles[0]
 
 	iniName := strings.TrimSuffix(
@@ -134,10 +384,9 @@ func newIniCfgFromFiles(iniFiles []string) *IniCfg {
 		Paths: iniFiles,
 		ModTimes: make([]time.Time, len(iniFiles)),
 		Raws: make([]string, len(iniFiles)),
+		live: &liveCfg{},
 	}
 
-	cfg.Reparse()
-
 	return &cfg
 }
 
@@ -160,7 +409,7 @@ func newIniValue(key, valstring string) *IniValue {
 		Name: cleanIniToken(key),
 	}
 
-	val.parseValues(valstring)
+	val.parseValues(valstring, nil)
 
 	return &val
 }
@@ -175,13 +424,88 @@ func cleanIniToken(token string) string {
 	return clean
 }
 
-// init initializes the ini package. Primarily, it spawns a goroutine
-// which is responsible for handling ini change monitoring.
-func init() {
-	SetPollFreqSec(DefaultPollFreqSec)
-	go func() {
-		defer crash.HandleAll()
-		monitorInis()
-		ForceUpdate()
-	}()
+// checkToken verifies that the given section name or key can be written
+// out and read back in by the parser unchanged.
+func checkToken(token string) error {
+	clean := cleanIniToken(token)
+
+	if clean == "" ||
+		strings.ContainsAny(clean, "=\r\n") ||
+		strings.HasPrefix(clean, "#") ||
+		strings.HasPrefix(clean, ";") ||
+		strings.HasPrefix(clean, "[") {
+		return fmt.Errorf("ini: invalid section or key name %q", token)
+	}
+
+	return nil
+}
+
+// checkKey verifies that the given key can be written out and read back in
+// by the parser unchanged. In addition to the checks made by checkToken, a
+// key may not begin with a "!" or "+" override marker (see Options).
+func checkKey(key string) error {
+	if err := checkToken(key); err != nil {
+		return err
+	}
+
+	clean := cleanIniToken(key)
+	if strings.HasPrefix(clean, "!") || strings.HasPrefix(clean, "+") {
+		return fmt.Errorf("ini: invalid key name %q", key)
+	}
+
+	return nil
+}
+
+// checkValue verifies that the given individual value can be written out
+// and read back in by the parser unchanged.
+func checkValue(value string) error {
+	if strings.ContainsAny(value, ",#\r\n") || strings.TrimSpace(value) != value {
+		return fmt.Errorf("ini: value %q cannot be represented in an ini file", value)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the output of writer to a temporary file in the
+// same directory as filePath, and then renames it over filePath, so that
+// readers (including the ini monitor) never observe a partially written file.
+// The permissions of any pre-existing file are preserved.
+func writeFileAtomic(filePath string, writer io.WriterTo) error {
+	dir, base := filepath.Split(filePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	bw := bufio.NewWriter(f)
+	_, err = writer.WriteTo(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
 }
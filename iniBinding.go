@@ -0,0 +1,164 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniBinding.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Binding holds a struct which is kept up to date with changes to an ini
+// file. See Bind.
+type Binding struct {
+	cfg     *IniCfg
+	id      uint32
+	initial *IniCfg
+	proto   reflect.Value
+	value   atomic.Value
+
+	lock sync.Mutex
+	err  error
+}
+
+// validator is implemented by bound structs which wish to verify their
+// contents after being populated.
+type validator interface {
+	Validate() error
+}
+
+// Bind populates the struct pointed to by v from cfg, as per IniCfg.Unmarshal,
+// and subscribes to changes to cfg so that the struct is re-populated whenever
+// the underlying ini files change. If *v has a Validate() error method, it is
+// called after each population, and a non-nil result is treated as a failure.
+//
+// Each reload is decoded into a fresh copy of the struct, starting from the
+// contents *v had when Bind was called, and is published only if decoding and
+// validation both succeed, so that a bad edit never results in a partially
+// applied configuration. Sections held by pointer are copied along with the
+// struct, rather than shared with it. The current struct is retrieved with
+// Load; v itself is never modified after Bind returns.
+//
+// An error is returned, and no subscription made, if the initial population
+// fails.
+func Bind(cfg *IniCfg, v interface{}) (*Binding, error) {
+	rv, err := structPtr(v)
+	if err != nil {
+		return nil, err
+	}
+
+	b := Binding{
+		cfg:     cfg,
+		initial: cfg.Snapshot(),
+		proto:   copyStruct(rv),
+	}
+
+	if err = b.update(b.initial, v); err != nil {
+		return nil, err
+	}
+
+	b.id = Subscribe(cfg, b.onChange)
+
+	return &b, nil
+}
+
+// Close unsubscribes the binding from further changes. The last successfully
+// loaded struct remains available through Load.
+func (this *Binding) Close() {
+	Unsubscribe(this.cfg, this.id)
+}
+
+// Err returns the error from the most recent reload, or nil if it succeeded.
+func (this *Binding) Err() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.err
+}
+
+// Load returns a pointer to the most recently populated struct. It is of the
+// same type as the pointer given to Bind, and must not be modified.
+func (this *Binding) Load() interface{} {
+	return this.value.Load()
+}
+
+// onChange is the subscription callback which re-populates the bound struct
+// whenever the config changes.
+func (this *Binding) onChange(cfg *IniCfg, changeCount int) {
+	if changeCount == 0 && cfg == this.initial {
+		// already populated by Bind; a newer snapshot means a change was
+		// published before the subscription was made
+		return
+	}
+
+	next := copyStruct(this.proto.Elem())
+
+	err := this.update(cfg, next.Interface())
+
+	this.lock.Lock()
+	this.err = err
+	this.lock.Unlock()
+}
+
+// update populates v from cfg and validates it, publishing it as the current
+// struct if both succeed.
+func (this *Binding) update(cfg *IniCfg, v interface{}) error {
+	err := cfg.Unmarshal(v)
+	if err != nil {
+		return err
+	}
+
+	if val, ok := v.(validator); ok {
+		if err = val.Validate(); err != nil {
+			return err
+		}
+	}
+
+	this.value.Store(v)
+
+	return nil
+}
+
+// copyStruct returns a pointer to a copy of the struct held in rv, in which
+// each non-nil pointer to a section is replaced by a pointer to a copy of that
+// section, so that populating the copy never modifies the original.
+func copyStruct(rv reflect.Value) reflect.Value {
+	cp := reflect.New(rv.Type())
+	cp.Elem().Set(rv)
+
+	copySections(cp.Elem())
+
+	return cp
+}
+
+// copySections replaces each non-nil pointer to a section within the struct
+// held in rv, including those nested within sections held by value, with a
+// pointer to a copy.
+func copySections(rv reflect.Value) {
+	for i := 0; i < rv.NumField(); i++ {
+		fv := rv.Field(i)
+
+		if !fv.CanSet() || !isSectionType(fv.Type()) {
+			continue
+		}
+
+		if fv.Kind() != reflect.Ptr {
+			copySections(fv)
+			continue
+		}
+
+		if !fv.IsNil() {
+			fv.Set(copyStruct(fv.Elem()))
+		}
+	}
+}
@@ -0,0 +1,287 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniDiff.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeType describes how a section or key differs between two configs.
+type ChangeType int
+
+// Supported change types.
+const (
+	Added ChangeType = iota + 1
+	Removed
+	Modified
+)
+
+// ConfigDiff describes the differences between two versions of a config, as
+// computed by Diff. Sections lists every section which was added, removed or
+// modified, sorted by name.
+type ConfigDiff struct {
+	Sections []SectionDiff
+}
+
+// SectionDiff describes the differences within a single section. Keys lists
+// every key which was added, removed or modified, sorted by name. When a
+// whole section is added or removed, all of its keys are listed as added or
+// removed respectively.
+type SectionDiff struct {
+	Name   string
+	Change ChangeType
+	Keys   []KeyDiff
+}
+
+// KeyDiff describes the differences in the values of a single key. Old and
+// New hold the Values of each instance of the key in the old and new configs
+// respectively, and are empty if the key was added or removed.
+type KeyDiff struct {
+	Name   string
+	Change ChangeType
+	Old    [][]string
+	New    [][]string
+}
+
+// Diff returns the differences between the old and new versions of a config.
+// Either may be nil, in which case it is treated as an empty config. Only
+// semantic differences are reported; changes to comments and formatting are
+// ignored.
+func Diff(oldCfg, newCfg *IniCfg) *ConfigDiff {
+	diff := ConfigDiff{
+		Sections: make([]SectionDiff, 0),
+	}
+
+	oldSecs := sectionsOf(oldCfg)
+	newSecs := sectionsOf(newCfg)
+
+	for _, name := range unionKeys(oldSecs, newSecs) {
+		oldSec, inOld := oldSecs[name]
+		newSec, inNew := newSecs[name]
+
+		secDiff := SectionDiff{
+			Name:   name,
+			Change: Modified,
+		}
+
+		switch {
+		case !inOld:
+			secDiff.Change = Added
+			oldSec = VoidSection
+		case !inNew:
+			secDiff.Change = Removed
+			newSec = VoidSection
+		case oldSec.ConfigVer == newSec.ConfigVer:
+			continue
+		}
+
+		secDiff.Keys = diffValues(oldSec.Values, newSec.Values)
+		if len(secDiff.Keys) < 1 && secDiff.Change == Modified {
+			continue
+		}
+
+		diff.Sections = append(diff.Sections, secDiff)
+	}
+
+	return &diff
+}
+
+// Empty returns true if the diff contains no changes.
+func (this *ConfigDiff) Empty() bool {
+	return len(this.Sections) < 1
+}
+
+// Section returns the differences within the named section, or nil if the
+// section is unchanged.
+func (this *ConfigDiff) Section(sectionName string) *SectionDiff {
+	secName := cleanIniToken(sectionName)
+
+	for i := range this.Sections {
+		if this.Sections[i].Name == secName {
+			return &this.Sections[i]
+		}
+	}
+
+	return nil
+}
+
+// String prints a human-readable representation of the diff.
+func (this *ConfigDiff) String() string {
+	var buf bytes.Buffer
+
+	for i := range this.Sections {
+		buf.WriteString(this.Sections[i].String())
+	}
+
+	return buf.String()
+}
+
+// Key returns the differences in the named key, or nil if the key is
+// unchanged.
+func (this *SectionDiff) Key(key string) *KeyDiff {
+	ckey := cleanIniToken(key)
+
+	for i := range this.Keys {
+		if this.Keys[i].Name == ckey {
+			return &this.Keys[i]
+		}
+	}
+
+	return nil
+}
+
+// String prints a human-readable representation of the section diff and its
+// children key diffs.
+func (this *SectionDiff) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%s [%s]\n", this.Change, this.Name))
+
+	for i := range this.Keys {
+		key := this.Keys[i]
+		buf.WriteString(fmt.Sprintf(
+			"    %s %s: %s -> %s\n",
+			key.Change,
+			key.Name,
+			formatInstances(key.Old),
+			formatInstances(key.New),
+		))
+	}
+
+	return buf.String()
+}
+
+// String returns a human-readable name for the change type.
+func (this ChangeType) String() string {
+	switch this {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	}
+
+	return fmt.Sprintf("ChangeType(%d)", int(this))
+}
+
+// diffValues returns the differences between two sets of key/value pairs.
+func diffValues(oldVals, newVals map[string][]*IniValue) []KeyDiff {
+	keys := make([]string, 0)
+	for key := range oldVals {
+		keys = append(keys, key)
+	}
+	for key := range newVals {
+		if _, ok := oldVals[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := make([]KeyDiff, 0)
+
+	for _, key := range keys {
+		keyDiff := KeyDiff{
+			Name:   key,
+			Change: Modified,
+			Old:    instancesOf(oldVals[key]),
+			New:    instancesOf(newVals[key]),
+		}
+
+		switch {
+		case len(keyDiff.Old) < 1:
+			keyDiff.Change = Added
+		case len(keyDiff.New) < 1:
+			keyDiff.Change = Removed
+		case equalInstances(keyDiff.Old, keyDiff.New):
+			continue
+		}
+
+		diffs = append(diffs, keyDiff)
+	}
+
+	return diffs
+}
+
+// equalInstances returns true if a and b hold identical values.
+func equalInstances(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// formatInstances returns a human-readable representation of the values of
+// each instance of a key.
+func formatInstances(instances [][]string) string {
+	if len(instances) < 1 {
+		return "(none)"
+	}
+
+	parts := make([]string, len(instances))
+	for i := range instances {
+		parts[i] = fmt.Sprintf("[%s]", strings.Join(instances[i], ", "))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// instancesOf returns the Values of each of the given IniValue objects.
+func instancesOf(vals []*IniValue) [][]string {
+	instances := make([][]string, len(vals))
+	for i := range vals {
+		instances[i] = vals[i].Values
+	}
+
+	return instances
+}
+
+// sectionsOf returns the sections of the given config, which may be nil.
+func sectionsOf(cfg *IniCfg) map[string]*IniSection {
+	if cfg == nil {
+		return nil
+	}
+
+	return cfg.Sections
+}
+
+// unionKeys returns the sorted union of the section names of a and b.
+func unionKeys(a, b map[string]*IniSection) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,181 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniErrors.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Diagnostic describes a problem with a single line of an ini file, such as
+// a key/value pair appearing before any section header, or a section header
+// which is missing its closing bracket. Line and Column are 1-based, and
+// Column refers to the first non-whitespace byte of the offending line.
+type Diagnostic struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// String returns the diagnostic in the conventional path:line:col: message
+// format understood by most editors.
+func (this Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", this.Path, this.Line, this.Column, this.Message)
+}
+
+// DiagnosticsError is returned when loading a config in strict mode and one
+// or more diagnostics were produced while parsing. Diagnostics contains every
+// problem found across all of the config's files, in file and line order.
+type DiagnosticsError struct {
+	Diagnostics []Diagnostic
+}
+
+// Error implements the error interface.
+func (this *DiagnosticsError) Error() string {
+	if len(this.Diagnostics) == 1 {
+		return fmt.Sprintf("ini: %s", this.Diagnostics[0])
+	}
+
+	return fmt.Sprintf(
+		"ini: %s (and %d more problems)",
+		this.Diagnostics[0],
+		len(this.Diagnostics)-1,
+	)
+}
+
+// Errors returned by the package.
+var (
+	// ErrIncludeCycle is returned, wrapped in a *ParseError identifying
+	// the offending directive, when a file directly or indirectly
+	// includes itself.
+	ErrIncludeCycle = errors.New("ini: include cycle")
+
+	// ErrInvalidTarget is returned by Unmarshal when it is not given a
+	// non-nil pointer to a struct.
+	ErrInvalidTarget = errors.New("ini: Unmarshal requires a non-nil pointer to a struct")
+
+	// ErrNoFiles is returned by LoadFiles when it is given an empty list
+	// of paths.
+	ErrNoFiles = errors.New("ini: no files to load")
+
+	// ErrSectionExists is returned by RenameSection when the target name
+	// is already in use by another section.
+	ErrSectionExists = errors.New("ini: section already exists")
+
+	// ErrSectionNotFound is returned by RenameSection when the section to
+	// be renamed does not exist.
+	ErrSectionNotFound = errors.New("ini: section not found")
+
+	// ErrVoid is returned when attempting to modify VoidSection or
+	// VoidValue.
+	ErrVoid = errors.New("ini: cannot modify VoidSection or VoidValue")
+)
+
+// ParseError describes a failure to open, stat or read one of the files
+// contributing to an IniCfg. Line is the 1-based line number at which the
+// failure occurred, or 0 if the failure was not tied to a particular line
+// (for instance, when the file could not be opened at all).
+type ParseError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+// Error implements the error interface.
+func (this *ParseError) Error() string {
+	if this.Line > 0 {
+		return fmt.Sprintf("ini: %s:%d: %v", this.Path, this.Line, this.Err)
+	}
+
+	return fmt.Sprintf("ini: %s: %v", this.Path, this.Err)
+}
+
+// Unwrap returns the underlying error so that callers can use errors.Is
+// (ex: errors.Is(err, os.ErrNotExist)) on the result of a Load call.
+func (this *ParseError) Unwrap() error {
+	return this.Err
+}
+
+// MissingKey identifies a required section or key which was not present in
+// the configuration. Key is empty if the entire section was missing.
+type MissingKey struct {
+	Section string
+	Key     string
+}
+
+// String returns the missing section and key in the form "[section] key".
+func (this MissingKey) String() string {
+	if this.Key == "" {
+		return fmt.Sprintf("[%s]", this.Section)
+	}
+
+	return fmt.Sprintf("[%s] %s", this.Section, this.Key)
+}
+
+// RequiredError is returned by Unmarshal when one or more sections or keys
+// bound to struct fields tagged `required:"true"` are missing. Missing lists
+// every one of them, in struct field order.
+type RequiredError struct {
+	Missing []MissingKey
+}
+
+// Error implements the error interface.
+func (this *RequiredError) Error() string {
+	missing := make([]string, len(this.Missing))
+	for i := range this.Missing {
+		missing[i] = this.Missing[i].String()
+	}
+
+	return fmt.Sprintf("ini: missing required keys: %s", strings.Join(missing, ", "))
+}
+
+// UnmarshalError describes a value which could not be converted to the type
+// of the struct field it is bound to. Instance is the index of the offending
+// IniValue among repeated instances of the key, and Offset is the index of
+// the value within that IniValue's Values.
+type UnmarshalError struct {
+	Section  string
+	Key      string
+	Instance int
+	Offset   int
+	Value    string
+	Type     reflect.Type
+	Err      error
+}
+
+// Error implements the error interface.
+func (this *UnmarshalError) Error() string {
+	instance := ""
+	if this.Instance > 0 {
+		instance = fmt.Sprintf(" (instance %d)", this.Instance)
+	}
+
+	return fmt.Sprintf(
+		"ini: cannot unmarshal [%s] %s%s offset %d (%q) into %s: %v",
+		this.Section,
+		this.Key,
+		instance,
+		this.Offset,
+		this.Value,
+		this.Type,
+		this.Err,
+	)
+}
+
+// Unwrap returns the underlying conversion error.
+func (this *UnmarshalError) Unwrap() error {
+	return this.Err
+}
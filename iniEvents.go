@@ -0,0 +1,350 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniEvents.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"context"
+	"sync"
+)
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+// Supported event types.
+const (
+	// EventChanged is delivered when a new snapshot of the config has been
+	// published, and once upon subscription with the current snapshot.
+	EventChanged EventType = iota + 1
+
+	// EventRejected is delivered when a change was detected but could not
+	// be parsed, or was rejected by the config's validator (see
+	// SetValidator). The previous snapshot remains published.
+	EventRejected
+
+	// EventFileRemoved is delivered when one of the config's files is
+	// found to have been deleted.
+	EventFileRemoved
+
+	// EventFileAppeared is delivered when a previously missing file is
+	// found to exist.
+	EventFileAppeared
+
+	// EventFileUnreadable is delivered when one of the config's files
+	// exists but cannot be read, for example due to its permissions.
+	EventFileUnreadable
+)
+
+// Event describes a change to a monitored config. Cfg is the newly published
+// snapshot, and Old the snapshot it replaced, which is nil for the event
+// delivered upon subscription. ChangeCount is the number of changes published
+// since the config was first monitored.
+//
+// For EventRejected events, Cfg is the snapshot which remains published, Err
+// is the reason the change was rejected and Rejected describes the rejected
+// version.
+//
+// For file lifecycle events, Cfg is the current snapshot and Path the file
+// concerned; Err holds the error encountered for EventFileUnreadable. Any
+// change to the config resulting from the file's removal or reappearance is
+// delivered by a subsequent EventChanged event.
+type Event struct {
+	Type        EventType
+	Cfg         *IniCfg
+	Old         *IniCfg
+	ChangeCount int
+	Err         error
+	Path        string
+	Rejected    *Rejection
+}
+
+// Rejection describes a version of a config which was not published because
+// it could not be parsed, or failed validation. Cfg is the rejected config,
+// and ConfigVer its version. If the files could not be read or parsed, Cfg
+// holds everything parsed up until the failure.
+type Rejection struct {
+	Cfg       *IniCfg
+	ConfigVer string
+	Err       error
+}
+
+// SubscribeOptions controls the delivery of events to a subscriber.
+type SubscribeOptions struct {
+	// Coalesce causes events which are still waiting to be delivered when
+	// a new change is published to be merged with it, so that a slow
+	// subscriber only ever sees the latest snapshot. The merged event's
+	// Old field is the snapshot which preceded the first of the merged
+	// changes. File lifecycle events are never merged.
+	Coalesce bool
+}
+
+// monSubscriber is a registered subscription. Events are queued for each
+// subscriber by the monitor and delivered by the subscriber's own goroutine,
+// so that slow callbacks delay neither the monitor nor other subscribers, and
+// callbacks are free to subscribe and unsubscribe.
+type monSubscriber struct {
+	ctx      context.Context
+	coalesce bool
+	detached bool
+	id       uint32
+	mon      *monIni
+	monitor  *Monitor
+	notify   func(Event)
+	onClose  func()
+	wake     chan struct{}
+
+	lock    sync.Mutex
+	queue   []queuedEvent
+	stopped bool
+}
+
+// queuedEvent is an event awaiting delivery. done is signalled once the
+// event has been delivered, merged or discarded. A queued flush carries no
+// event, and merely signals done once every event queued before it has been
+// delivered.
+type queuedEvent struct {
+	done  *sync.WaitGroup
+	event Event
+	flush bool
+}
+
+// Diff returns the differences between the old and new snapshots carried by
+// the event.
+func (this Event) Diff() *ConfigDiff {
+	return Diff(this.Old, this.Cfg)
+}
+
+// SubscribeContext is like Subscribe, but the subscription is removed
+// automatically when ctx is cancelled.
+func SubscribeContext(ctx context.Context, cfg *IniCfg, callback func(*IniCfg, int)) uint32 {
+	return defaultMonitor().SubscribeContext(ctx, cfg, callback)
+}
+
+// SubscribeEvents registers a callback which receives every Event published
+// for the given ini file until ctx is cancelled or the subscription is
+// removed with Unsubscribe. As with Subscribe, the callback is called once
+// with the current snapshot upon subscription, before SubscribeEvents
+// returns; subsequent events are delivered, in order, from a goroutine
+// dedicated to the subscription.
+func SubscribeEvents(
+	ctx context.Context,
+	cfg *IniCfg,
+	opts SubscribeOptions,
+	callback func(Event),
+) uint32 {
+	return defaultMonitor().SubscribeEvents(ctx, cfg, opts, callback)
+}
+
+// Watch returns a channel on which the events published for the given ini
+// file are delivered, beginning with an event carrying the current snapshot.
+// Events are coalesced while the receiver is busy, so that it always
+// receives the latest snapshot. The channel is closed once ctx is cancelled.
+// ForceUpdate does not wait for events to be received from the channel.
+func Watch(ctx context.Context, cfg *IniCfg) <-chan Event {
+	return defaultMonitor().Watch(ctx, cfg)
+}
+
+// SubscribeContext is like Subscribe, but the subscription is removed
+// automatically when ctx is cancelled.
+func (this *Monitor) SubscribeContext(
+	ctx context.Context,
+	cfg *IniCfg,
+	callback func(*IniCfg, int),
+) uint32 {
+	return this.subscribe(ctx, cfg, SubscribeOptions{}, func(ev Event) {
+		if ev.Type == EventChanged {
+			callback(ev.Cfg, ev.ChangeCount)
+		}
+	}, nil, false)
+}
+
+// SubscribeEvents registers a callback which receives every Event published
+// for the given ini file. See the package level SubscribeEvents.
+func (this *Monitor) SubscribeEvents(
+	ctx context.Context,
+	cfg *IniCfg,
+	opts SubscribeOptions,
+	callback func(Event),
+) uint32 {
+	return this.subscribe(ctx, cfg, opts, callback, nil, false)
+}
+
+// Watch returns a channel on which the events published for the given ini
+// file are delivered. See the package level Watch.
+func (this *Monitor) Watch(ctx context.Context, cfg *IniCfg) <-chan Event {
+	events := make(chan Event, 1)
+
+	this.subscribe(ctx, cfg, SubscribeOptions{Coalesce: true}, func(ev Event) {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	}, func() {
+		close(events)
+	}, true)
+
+	return events
+}
+
+// enqueue queues an event for delivery to the subscriber, merging it with
+// any undelivered event if the subscriber coalesces events. done is
+// incremented for the queued event, and decremented once it has been dealt
+// with.
+func (this *monSubscriber) enqueue(ev Event, done *sync.WaitGroup) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped {
+		return
+	}
+
+	if this.detached {
+		// nobody waits for deliveries to a detached subscriber
+		done = new(sync.WaitGroup)
+	}
+
+	done.Add(1)
+
+	// file lifecycle events each concern a different file, so only
+	// snapshot events are merged
+	last := len(this.queue) - 1
+	if this.coalesce &&
+		last >= 0 &&
+		!this.queue[last].flush &&
+		this.queue[last].event.Type == ev.Type &&
+		ev.Path == "" {
+		ev.Old = this.queue[last].event.Old
+		this.queue[last].done.Done()
+		this.queue = this.queue[:last]
+	}
+
+	this.queue = append(this.queue, queuedEvent{
+		done:  done,
+		event: ev,
+	})
+
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush queues a marker which signals done once every event already queued
+// for the subscriber has been delivered.
+func (this *monSubscriber) flush(done *sync.WaitGroup) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped || this.detached {
+		return
+	}
+
+	done.Add(1)
+
+	this.queue = append(this.queue, queuedEvent{
+		done:  done,
+		flush: true,
+	})
+
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next event from the subscriber's queue. It returns false
+// if the queue is empty.
+func (this *monSubscriber) pop() (queuedEvent, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped || len(this.queue) < 1 {
+		return queuedEvent{}, false
+	}
+
+	next := this.queue[0]
+	this.queue[0] = queuedEvent{}
+	this.queue = this.queue[1:]
+
+	return next, true
+}
+
+// run delivers queued events to the subscriber until it is stopped or its
+// context is cancelled.
+func (this *monSubscriber) run() {
+	if this.onClose != nil {
+		defer this.onClose()
+	}
+
+	for {
+		select {
+		case <-this.wake:
+		case <-this.ctx.Done():
+			this.monitor.lock.Lock()
+			if this.mon.subscribers[this.id] == this {
+				delete(this.mon.subscribers, this.id)
+				this.monitor.release(this.mon)
+			}
+			this.monitor.lock.Unlock()
+
+			this.stop()
+			return
+		}
+
+		for {
+			next, ok := this.pop()
+			if !ok {
+				break
+			}
+
+			if !next.flush {
+				this.notify(next.event)
+			}
+			next.done.Done()
+		}
+
+		if this.isStopped() {
+			return
+		}
+	}
+}
+
+// isStopped returns true once the subscriber has been stopped.
+func (this *monSubscriber) isStopped() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.stopped
+}
+
+// stop discards any undelivered events and causes the subscriber's goroutine
+// to exit. It does not wait for a callback which is already running.
+func (this *monSubscriber) stop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped {
+		return
+	}
+
+	this.stopped = true
+
+	for i := range this.queue {
+		this.queue[i].done.Done()
+	}
+	this.queue = nil
+
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
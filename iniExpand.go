@@ -0,0 +1,231 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniExpand.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// expandRefs replaces each ${NAME} or ${NAME:-default} reference within
+// value with the value returned for NAME by lookup, which returns false if
+// NAME is undefined. The default is used if the value is undefined or empty,
+// and "$$" is replaced with a single "$". Any other "$" is left as is. If
+// strict is set, an error, formatted from undefinedFmt, is returned for
+// undefined names without a default, and an error is returned for
+// references which are not terminated; otherwise they expand to nothing, or
+// are left as is, respectively. Any error returned by lookup is returned
+// as is.
+func expandRefs(
+	value string,
+	lookup func(string) (string, bool, error),
+	strict bool,
+	undefinedFmt string,
+) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+
+	var buf bytes.Buffer
+
+	for len(value) > 0 {
+		idx := strings.Index(value, "$")
+		if idx < 0 || idx == len(value)-1 {
+			buf.WriteString(value)
+			break
+		}
+
+		buf.WriteString(value[:idx])
+		value = value[idx:]
+
+		switch value[1] {
+		case '$':
+			buf.WriteString("$")
+			value = value[2:]
+			continue
+
+		case '{':
+		default:
+			buf.WriteString("$")
+			value = value[1:]
+			continue
+		}
+
+		end := strings.Index(value, "}")
+		if end < 0 {
+			if strict {
+				return "", fmt.Errorf("unterminated variable reference %q", value)
+			}
+
+			buf.WriteString(value)
+			break
+		}
+
+		name := value[2:end]
+		def, hasDef := "", false
+		if sep := strings.Index(name, ":-"); sep >= 0 {
+			name, def, hasDef = name[:sep], name[sep+2:], true
+		}
+
+		refVal, ok, err := lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case refVal != "":
+			buf.WriteString(refVal)
+		case hasDef:
+			buf.WriteString(def)
+		case !ok && strict:
+			return "", fmt.Errorf(undefinedFmt, name)
+		}
+
+		value = value[end+1:]
+	}
+
+	return buf.String(), nil
+}
+
+// interpolate expands the ${section.key} and ${key} references within the
+// values read from the config's files, once all of the files have been
+// merged. A Diagnostic is recorded for each value which cannot be expanded,
+// in which case its values are left unexpanded.
+func (this *IniCfg) interpolate() {
+	resolved := make(map[*IniValue]bool)
+	failed := len(this.errs)
+
+	for _, secName := range this.keys {
+		sec := this.Sections[secName]
+
+		for _, key := range sec.keys {
+			for _, val := range sec.Values[key] {
+				this.resolveRefs(sec, val, resolved, nil)
+			}
+		}
+	}
+
+	// report any new problems in file and line order
+	layers := make(map[string]int)
+	for i := len(this.Paths) - 1; i >= 0; i-- {
+		layers[this.Paths[i]] = i
+	}
+
+	problems := this.errs[failed:]
+	sort.SliceStable(problems, func(i, j int) bool {
+		if layers[problems[i].Path] != layers[problems[j].Path] {
+			return layers[problems[i].Path] < layers[problems[j].Path]
+		}
+
+		return problems[i].Line < problems[j].Line
+	})
+}
+
+// findRef returns the value named by a reference from within sec, along with
+// the section containing it, or nil if there is no such value. The name is
+// first split at its last dot into a section name and key, and otherwise
+// taken to be a key within sec.
+func (this *IniCfg) findRef(sec *IniSection, name string) (*IniSection, *IniValue) {
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		target, ok := this.Sections[cleanIniToken(name[:idx])]
+		if ok && len(target.Values[cleanIniToken(name[idx+1:])]) > 0 {
+			return target, target.GetVal(name[idx+1:])
+		}
+	}
+
+	if len(sec.Values[cleanIniToken(name)]) > 0 {
+		return sec, sec.GetVal(name)
+	}
+
+	return nil, nil
+}
+
+// resolveRefs expands the references within the given value, first
+// expanding those within any value it refers to. resolved records the values
+// which have already been expanded (true), or are being expanded (false),
+// and chain lists the references followed to reach the value, so that cycles
+// are detected.
+func (this *IniCfg) resolveRefs(
+	sec *IniSection,
+	val *IniValue,
+	resolved map[*IniValue]bool,
+	chain []string,
+) {
+	if _, ok := resolved[val]; ok || val.line == nil {
+		return
+	}
+
+	raw := stripEOLComment(val.line.token())
+	if !strings.Contains(raw, "$") {
+		resolved[val] = true
+		return
+	}
+
+	resolved[val] = false
+	chain = append(chain, fmt.Sprintf("%s.%s", sec.Name, val.Name))
+
+	lookup := func(name string) (string, bool, error) {
+		targetSec, target := this.findRef(sec, name)
+		if target == nil {
+			if this.opts.ExpandEnv {
+				return lookupEnv(name)
+			}
+
+			return "", false, nil
+		}
+
+		if done, ok := resolved[target]; ok && !done {
+			return "", false, fmt.Errorf(
+				"reference cycle: %s -> %s.%s",
+				strings.Join(chain, " -> "),
+				targetSec.Name,
+				target.Name,
+			)
+		}
+
+		this.resolveRefs(targetSec, target, resolved, chain)
+
+		return strings.Join(target.Values, ", "), true, nil
+	}
+
+	// references which are neither keys nor (when ExpandEnv is set)
+	// environment variables are errors, unless the environment is
+	// expanded leniently
+	strict := !this.opts.ExpandEnv || this.opts.StrictEnv
+
+	expanded, err := expandRefs(raw, lookup, strict, "reference %q is not defined")
+	resolved[val] = true
+
+	if err != nil {
+		this.errs = append(this.errs, Diagnostic{
+			Path:    val.doc.Path,
+			Line:    val.line.Num,
+			Column:  val.line.column(),
+			Message: err.Error(),
+		})
+
+		return
+	}
+
+	val.Values = splitValues(expanded)
+}
+
+// lookupEnv looks up the named environment variable, for use with
+// expandRefs.
+func lookupEnv(name string) (string, bool, error) {
+	envVal, ok := os.LookupEnv(name)
+	return envVal, ok, nil
+}
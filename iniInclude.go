@@ -0,0 +1,297 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniInclude.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// includeGlob records a glob pattern named by an include directive, along
+// with the files it matched when the config was parsed, so that the monitor
+// can detect files which are added or removed.
+type includeGlob struct {
+	fsys    fs.FS
+	pattern string
+	matches []string
+}
+
+// refresh expands the pattern again, returning true if the files it matches
+// have changed since it was last expanded.
+func (this *includeGlob) refresh() bool {
+	matches, err := this.expand()
+	if err != nil {
+		return false
+	}
+
+	changed := len(matches) != len(this.matches)
+	for i := 0; !changed && i < len(matches); i++ {
+		changed = matches[i] != this.matches[i]
+	}
+
+	this.matches = matches
+
+	return changed
+}
+
+// expand returns the files, excluding directories, currently matched by the
+// pattern, in lexical order.
+func (this *includeGlob) expand() ([]string, error) {
+	var matches []string
+	var err error
+
+	if this.fsys != nil {
+		matches, err = fs.Glob(this.fsys, this.pattern)
+	} else {
+		matches, err = filepath.Glob(this.pattern)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(matches))
+
+	for _, match := range matches {
+		var info fs.FileInfo
+
+		if this.fsys != nil {
+			info, err = fs.Stat(this.fsys, match)
+		} else {
+			info, err = os.Stat(match)
+		}
+
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		files = append(files, match)
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// includes returns the include directives within the document: every include
+// line, along with any include or includedir key/value pairs appearing before
+// the first section header.
+func (this *IniDocument) includes() []*IniLine {
+	lines := make([]*IniLine, 0)
+	inSection := false
+
+	for _, line := range this.Lines {
+		switch line.Kind {
+		case SectionLine:
+			inSection = true
+
+		case IncludeLine:
+			lines = append(lines, line)
+
+		case KeyValLine:
+			if !inSection && isIncludeKey(line.Name) && line.token() != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return lines
+}
+
+// addPath appends an entry for the given file to Paths, and the other
+// per-file fields of the IniCfg, returning its index.
+func (this *IniCfg) addPath(file Layer, included bool) int {
+	this.Paths = append(this.Paths, file.Path)
+	this.ModTimes = append(this.ModTimes, time.Time{})
+	this.Raws = append(this.Raws, "")
+	this.fsys = append(this.fsys, file.FS)
+	this.included = append(this.included, included)
+
+	return len(this.Paths) - 1
+}
+
+// checkInclude records a warning for an include directive which cannot be
+// followed.
+func (this *IniCfg) checkInclude(line *IniLine, warn func(string)) {
+	switch {
+	case this.inMemory:
+		warn("include directives are not supported in configs parsed from memory")
+
+	case line.token() == "":
+		warn("include directive is missing a path")
+	}
+}
+
+// includeFile reads and parses the given file, adding it to the config
+// followed, depth first, by each of the files it includes. scope is the index
+// of the root file from which the file was reached. loaded holds every file
+// already added to the config, which are not included again, and active the
+// files currently being included, which may not name themselves explicitly;
+// glob matches of active files are skipped.
+func (this *IniCfg) includeFile(
+	file Layer,
+	scope int,
+	included bool,
+	loaded, active map[string]bool,
+) error {
+	key := includeKey(file, scope)
+	loaded[key] = true
+	active[key] = true
+	defer delete(active, key)
+
+	index := this.addPath(file, included)
+
+	err := this.readFile(index)
+	if err != nil {
+		return err
+	}
+
+	doc := parseDocument(file.Path, this.Raws[index])
+	this.docs = append(this.docs, doc)
+	this.addDocument(doc)
+
+	for _, line := range doc.includes() {
+		targets, matched, err := this.resolveInclude(file, line)
+		if err != nil {
+			return &ParseError{Path: file.Path, Line: line.Num, Err: err}
+		}
+
+		for _, target := range targets {
+			targetKey := includeKey(target, scope)
+
+			if active[targetKey] && !matched {
+				return &ParseError{Path: file.Path, Line: line.Num, Err: ErrIncludeCycle}
+			}
+
+			if loaded[targetKey] {
+				continue
+			}
+
+			err = this.includeFile(target, scope, true, loaded, active)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveInclude returns the files named by the given include directive
+// within file. Relative paths are resolved against the directory containing
+// file, and glob patterns are expanded and recorded for the monitor. matched
+// is true if the files were matched by a glob pattern or included directory,
+// rather than named explicitly.
+func (this *IniCfg) resolveInclude(
+	file Layer,
+	line *IniLine,
+) (targets []Layer, matched bool, err error) {
+	if this.inMemory {
+		return nil, false, nil
+	}
+
+	target := line.token()
+	dir := cleanIniToken(line.Name) == "includedir"
+
+	if file.FS != nil {
+		// fs.FS paths are always relative to the root of the FS
+		if path.IsAbs(target) {
+			target = strings.TrimPrefix(path.Clean(target), "/")
+		} else {
+			target = path.Join(path.Dir(file.Path), target)
+		}
+
+		if dir {
+			target = path.Join(target, "*.ini")
+		}
+	} else {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(file.Path), target)
+		}
+
+		if dir {
+			target = filepath.Join(target, "*.ini")
+		}
+	}
+
+	if !dir && !strings.ContainsAny(target, "*?[") {
+		return []Layer{{FS: file.FS, Path: target}}, false, nil
+	}
+
+	glob := includeGlob{
+		fsys:    file.FS,
+		pattern: target,
+	}
+
+	matches, err := glob.expand()
+	if err != nil {
+		return nil, true, err
+	}
+
+	glob.matches = matches
+	this.globs = append(this.globs, glob)
+
+	targets = make([]Layer, len(matches))
+	for i := range matches {
+		targets[i] = Layer{FS: file.FS, Path: matches[i]}
+	}
+
+	return targets, true, nil
+}
+
+// rootLayers returns the files originally given to the config, excluding
+// those which were pulled in by include directives. If Paths has been
+// replaced since the config was last parsed, every path is treated as an
+// original file.
+func (this *IniCfg) rootLayers() []Layer {
+	roots := make([]Layer, 0, len(this.Paths))
+
+	for i := range this.Paths {
+		if len(this.included) == len(this.Paths) && this.included[i] {
+			continue
+		}
+
+		roots = append(roots, Layer{FS: this.layerFS(i), Path: this.Paths[i]})
+	}
+
+	return roots
+}
+
+// includeKey returns a key identifying the given file, so that files
+// reached more than once are recognized. Files within an fs.FS are
+// identified by the scope in which they were reached, since file systems
+// cannot, in general, be compared.
+func includeKey(file Layer, scope int) string {
+	if file.FS != nil {
+		return fmt.Sprintf("fs%d:%s", scope, path.Clean(file.Path))
+	}
+
+	absPath, err := filepath.Abs(file.Path)
+	if err != nil {
+		absPath = filepath.Clean(file.Path)
+	}
+
+	return "os:" + absPath
+}
+
+// isIncludeKey returns true if the given key names an include directive.
+func isIncludeKey(key string) bool {
+	ckey := cleanIniToken(key)
+	return ckey == "include" || ckey == "includedir"
+}
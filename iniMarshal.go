@@ -0,0 +1,384 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniMarshal.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// textMarshalerType is the reflect type of encoding.TextMarshaler.
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// MarshalOptions controls the output of MarshalWithOptions and MarshalCfg.
+//
+// By default, keys whose fields hold the zero value for their type are
+// omitted from the output, unless the field has a `default:"..."` tag, in
+// which case the zero value is written so that Unmarshal does not replace it
+// with the default. Set EmitDefaults to write every key, which is useful when
+// generating sample configuration files; zero valued fields with a default
+// tag are then written with the value of that tag instead. Comments taken from
+// `comment:"..."` struct tags are written above the corresponding section
+// header or key unless OmitComments is set.
+type MarshalOptions struct {
+	EmitDefaults bool
+	OmitComments bool
+}
+
+// Marshal returns the ini encoding of v, which must be a struct or a pointer
+// to a struct, using the default MarshalOptions.
+func Marshal(v interface{}) ([]byte, error) {
+	return MarshalWithOptions(v, MarshalOptions{})
+}
+
+// MarshalWithOptions returns the ini encoding of v, which must be a struct or
+// a pointer to a struct. Fields are mapped to sections and keys in the same
+// manner as Unmarshal, so that unmarshalling the output reproduces v, and
+// sections and keys are written in struct field order.
+func MarshalWithOptions(v interface{}, opts MarshalOptions) ([]byte, error) {
+	cfg, err := MarshalCfg(v, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(cfg.docs[0].String()), nil
+}
+
+// MarshalCfg behaves like MarshalWithOptions, but returns the result as a new
+// IniCfg consisting of a single document, which may be further edited before
+// being written out with WriteTo or Save.
+func MarshalCfg(v interface{}, opts MarshalOptions) (*IniCfg, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ini: cannot marshal %T, expected a struct", v)
+	}
+
+	doc := IniDocument{
+		Lines: make([]*IniLine, 0),
+	}
+
+	enc := marshaller{
+		doc:  &doc,
+		opts: opts,
+	}
+
+	if err := enc.marshalCfg(rv); err != nil {
+		return nil, err
+	}
+
+	cfg := IniCfg{
+		Name:     cleanIniToken(rv.Type().Name()),
+		Sections: make(map[string]*IniSection, 0),
+		docs:     []*IniDocument{&doc},
+		keys:     make([]string, 0),
+		live:     &liveCfg{},
+	}
+
+	cfg.addDocument(&doc)
+	cfg.computeHashes()
+
+	return &cfg, nil
+}
+
+// marshaller holds the state of a single call to MarshalCfg.
+type marshaller struct {
+	doc  *IniDocument
+	opts MarshalOptions
+}
+
+// marshalCfg writes a section for each of the section fields of the struct
+// held in rv.
+func (this *marshaller) marshalCfg(rv reflect.Value) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+
+			fv = fv.Elem()
+		}
+
+		if field.Anonymous && fv.Kind() == reflect.Struct {
+			if err := this.marshalCfg(fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !isSectionType(field.Type) {
+			continue
+		}
+
+		if err := checkToken(name); err != nil {
+			return err
+		}
+
+		if len(this.doc.Lines) > 0 {
+			this.appendLine(newIniLine(""))
+		}
+
+		this.appendComment(field)
+		this.appendLine(newSectionLine(name))
+
+		if err := this.marshalSection(name, fv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalSection writes a key for each of the fields of the struct held in
+// rv.
+func (this *marshaller) marshalSection(section string, rv reflect.Value) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if field.Anonymous && isSectionType(field.Type) {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+
+				fv = fv.Elem()
+			}
+
+			if err := this.marshalSection(section, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var vals []string
+		var err error
+
+		def, hasDef := field.Tag.Lookup("default")
+
+		switch {
+		case fv.IsZero() && hasDef && this.opts.EmitDefaults:
+			vals, err = []string{def}, checkDefault(field.Type, def)
+		case fv.IsZero() && !this.opts.EmitDefaults && (!hasDef || !hasZeroText(fv)):
+			continue
+		default:
+			vals, err = formatKey(fv)
+		}
+
+		if err != nil {
+			return fmt.Errorf("ini: cannot marshal [%s] %s: %v", section, name, err)
+		}
+
+		if err = checkKey(name); err != nil {
+			return err
+		}
+
+		this.appendComment(field)
+		for i := range vals {
+			this.appendLine(newKeyValLine("", name, vals[i]))
+		}
+	}
+
+	return nil
+}
+
+// appendComment writes the contents of the comment tag of the given field,
+// if any, as one or more comment lines.
+func (this *marshaller) appendComment(field reflect.StructField) {
+	comment := field.Tag.Get("comment")
+	if comment == "" || this.opts.OmitComments {
+		return
+	}
+
+	for _, text := range strings.Split(comment, "\n") {
+		this.appendLine(newIniLine(strings.TrimRight("# "+text, " ")))
+	}
+}
+
+// appendLine adds line to the end of the document.
+func (this *marshaller) appendLine(line *IniLine) {
+	this.doc.insert(len(this.doc.Lines), line)
+}
+
+// formatKey returns the text of each line to be written for the field held
+// in fv: one line per inner slice for slice of slice fields, otherwise a
+// single line.
+func formatKey(fv reflect.Value) ([]string, error) {
+	ft := fv.Type()
+
+	switch {
+	case isSliceType(ft) && isSliceType(ft.Elem()):
+		lines := make([]string, fv.Len())
+		for i := range lines {
+			line, err := formatValues(fv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+
+			lines[i] = line
+		}
+
+		return lines, nil
+
+	case isSliceType(ft):
+		line, err := formatValues(fv)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{line}, nil
+
+	default:
+		val, err := formatScalar(fv)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{val}, nil
+	}
+}
+
+// checkDefault returns an error if the given default tag value, for a field
+// of type ft, cannot be written to an ini file as is.
+func checkDefault(ft reflect.Type, def string) error {
+	if !isSliceType(ft) {
+		return checkValue(def)
+	}
+
+	for _, val := range splitValues(def) {
+		if err := checkValue(val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasZeroText returns true if the zero value held in fv is written as text
+// which Unmarshal reads back as the zero value. Nil pointers and empty slices
+// are written as empty values, and so are not.
+func hasZeroText(fv reflect.Value) bool {
+	return fv.Kind() != reflect.Ptr && fv.Kind() != reflect.Slice
+}
+
+// formatValues returns the comma separated text of the elements of the slice
+// held in fv.
+func formatValues(fv reflect.Value) (string, error) {
+	vals := make([]string, fv.Len())
+
+	for i := range vals {
+		val, err := formatScalar(fv.Index(i))
+		if err != nil {
+			return "", err
+		}
+
+		vals[i] = val
+	}
+
+	return strings.Join(vals, ", "), nil
+}
+
+// formatScalar returns the text of the single value held in fv.
+func formatScalar(fv reflect.Value) (string, error) {
+	ft := fv.Type()
+
+	if ft.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			return "", nil
+		}
+
+		return formatScalar(fv.Elem())
+	}
+
+	var val string
+
+	switch {
+	case ft.Implements(textMarshalerType):
+		text, err := fv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return "", err
+		}
+		val = string(text)
+
+	case fv.CanAddr() && reflect.PtrTo(ft).Implements(textMarshalerType):
+		text, err := fv.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return "", err
+		}
+		val = string(text)
+
+	case ft == durationType:
+		val = time.Duration(fv.Int()).String()
+
+	case ft.Kind() == reflect.String:
+		val = fv.String()
+
+	case ft.Kind() == reflect.Bool:
+		val = strconv.FormatBool(fv.Bool())
+
+	case isKind(ft, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64):
+		val = strconv.FormatInt(fv.Int(), 10)
+
+	case isKind(ft, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64):
+		val = strconv.FormatUint(fv.Uint(), 10)
+
+	case isKind(ft, reflect.Float32, reflect.Float64):
+		val = strconv.FormatFloat(fv.Float(), 'g', -1, ft.Bits())
+
+	default:
+		return "", fmt.Errorf("unsupported type %s", ft)
+	}
+
+	if err := checkValue(val); err != nil {
+		return "", err
+	}
+
+	return val, nil
+}
+
+// isKind returns true if the kind of t is any of the given kinds.
+func isKind(t reflect.Type, kinds ...reflect.Kind) bool {
+	for i := range kinds {
+		if t.Kind() == kinds[i] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -13,170 +13,884 @@
 package ini
 
 import (
+	"github.com/xaevman/crash"
+
+	"context"
 	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// shutdownTimeout is the amount of time Shutdown waits for the default
+// monitor to stop.
+const shutdownTimeout = 30 * time.Second
+
+// watchDebounce is the amount of time the file watcher waits for a burst of
+// filesystem events to settle before triggering a check for changes.
+const watchDebounce = 50 * time.Millisecond
+
 var (
-	coreId          uint32
-	forceUpdateChan = make(chan chan interface{}, 0)
-	monitors        map[string]*monIni
-	monitorLock     sync.Mutex
-	pollFreqSec     uint32
+	coreId         uint32
+	defaultMon     *Monitor
+	defaultMonOnce sync.Once
 )
 
+// watcher is implemented by event driven (as opposed to polling) mechanisms
+// for detecting changes to monitored files. Where no such mechanism is
+// available, newWatcher returns an error and the monitor relies solely on
+// polling.
+type watcher interface {
+	// add begins watching for changes to the file at the given path.
+	// The final element of the path may be a glob pattern, in which case
+	// changes to any matching file are watched for.
+	add(filePath string) error
+
+	// close stops watching for changes.
+	close()
+
+	// events returns a channel which is signalled whenever a watched
+	// file may have changed.
+	events() <-chan struct{}
+
+	// healthy returns false if the watcher may be missing changes, in
+	// which case the monitor must poll.
+	healthy() bool
+}
+
+// MonitorOptions controls the behavior of a Monitor created by NewMonitor.
+type MonitorOptions struct {
+	// DisableWatcher causes the monitor to poll for changes even where an
+	// event driven file watcher is available.
+	DisableWatcher bool
+
+	// PollInterval is the interval at which files are checked for changes
+	// when they cannot be watched. It defaults to DefaultPollFreqSec
+	// seconds.
+	PollInterval time.Duration
+}
+
+// Monitor detects changes to the files of the configs registered with it,
+// publishing new snapshots of those configs and notifying their subscribers.
+// Each Monitor tracks its configs independently of any other. The package
+// level functions, such as Subscribe, operate on a default Monitor which is
+// started upon first use.
+type Monitor struct {
+	disableWatcher bool
+	pollInterval   int64
+
+	lock     sync.Mutex
+	done     chan struct{}
+	monitors map[*liveCfg]*monIni
+	rescan   chan struct{}
+	stop     chan struct{}
+	watcher  watcher
+}
+
 type monIni struct {
 	changeCount int
+	files       []monFile
+	globs       []includeGlob
 	iniFile     *IniCfg
 	name        string
+	notifyRaw   bool
+	rejected    *Rejection
 	subscribers map[uint32]*monSubscriber
+	validator   func(*IniCfg) error
 }
 
-type monSubscriber struct {
-	callback func(*IniCfg, int)
-	id       uint32
+// monFile records the size and modification time of a monitored file when
+// its content was last examined, and whether it was then missing or
+// unreadable.
+type monFile struct {
+	missing    bool
+	modTime    time.Time
+	size       int64
+	unreadable bool
 }
 
 // ClearSubscribers clears the list of subscriber functions for the given
 // ini file.
 func ClearSubscribers(cfg *IniCfg) {
-	monitorLock.Lock()
-	defer monitorLock.Unlock()
-
-	mon := getMonIni(cfg)
-	mon.subscribers = make(map[uint32]*monSubscriber)
+	defaultMonitor().ClearSubscribers(cfg)
 }
 
-// ForceUpdate cause an ini poll to happen via manual request.
+// ForceUpdate cause an ini poll to happen via manual request. It returns once
+// every subscriber has been notified of any changes detected by the poll, and
+// so must not be called from within a subscriber callback.
 func ForceUpdate() {
-	reply := make(chan interface{}, 0)
-	forceUpdateChan <- reply
-	<-reply
+	defaultMonitor().ForceUpdate()
+}
+
+// LastRejection returns the most recently rejected version of the given ini
+// file, or nil if the most recent change was published successfully.
+func LastRejection(cfg *IniCfg) *Rejection {
+	return defaultMonitor().LastRejection(cfg)
 }
 
 // SetPollFreqSec sets the frequency at which the underlying ini file is
 // checked for changes.
 func SetPollFreqSec(freqSec uint32) {
-	atomic.StoreUint32(&pollFreqSec, freqSec)
+	defaultMonitor().SetPollInterval(time.Duration(freqSec) * time.Second)
+}
+
+// SetNotifyOnRawChange controls whether subscribers to the given ini file are
+// notified of changes which do not affect its ConfigVer, such as edits to
+// comments or white space. By default, subscribers are only notified when a
+// change alters the semantic content of the config.
+func SetNotifyOnRawChange(cfg *IniCfg, enabled bool) {
+	defaultMonitor().SetNotifyOnRawChange(cfg, enabled)
+}
+
+// SetValidator registers a function which is called with each new version of
+// the given ini file before it is published. If it returns an error, the new
+// version is discarded, the previous snapshot remains published, and
+// subscribers receive an EventRejected event in place of EventChanged. The
+// validator is called by the monitor itself, and so must not call any of the
+// monitor's functions, such as Subscribe. A nil validator removes any
+// previously registered one.
+func SetValidator(cfg *IniCfg, validator func(*IniCfg) error) {
+	defaultMonitor().SetValidator(cfg, validator)
+}
+
+// Shutdown stops the default monitor, returning an error if it fails to stop
+// in a timely manner. Subscriptions are retained, and monitoring resumes if
+// any of the package level monitoring functions are subsequently called.
+func Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	defaultMonOnce.Do(initDefaultMonitor)
+
+	return defaultMon.Stop(ctx)
 }
 
 // Subscribe notifies the ini system that the given callback should be called
-// upon any changes to the given ini file.
+// upon any changes to the given ini file. The callback receives the newly
+// published snapshot of the config (see IniCfg.Snapshot), and is called once
+// with the current snapshot and a change count of 0 upon subscription, before
+// Subscribe returns. Subsequent calls are made, in order, from a goroutine
+// dedicated to the subscription (see SubscribeEvents).
 func Subscribe(cfg *IniCfg, callback func(*IniCfg, int)) uint32 {
-	newId := atomic.AddUint32(&coreId, 1)
+	return defaultMonitor().Subscribe(cfg, callback)
+}
 
-	monitorLock.Lock()
-	defer monitorLock.Unlock()
+// SubscribeDiff is like Subscribe, but the callback receives the differences
+// between the previous and new snapshots of the config (see Diff) rather than
+// a change count. Upon subscription, it is called once with a diff against an
+// empty config, in which every section and key is listed as added.
+func SubscribeDiff(cfg *IniCfg, callback func(*IniCfg, *ConfigDiff)) uint32 {
+	return defaultMonitor().SubscribeDiff(cfg, callback)
+}
 
-	mon := getMonIni(cfg)
+// SubscribeKey is like Subscribe, but the callback is only called when the
+// values of the given key, within the given section, change.
+func SubscribeKey(cfg *IniCfg, sectionName, key string, callback func(*IniCfg, int)) uint32 {
+	return defaultMonitor().SubscribeKey(cfg, sectionName, key, callback)
+}
 
-	sub := &monSubscriber{
-		callback: callback,
-		id:       newId,
+// SubscribeSection is like Subscribe, but the callback is only called when
+// the given section is added, removed, or its ConfigVer changes.
+func SubscribeSection(cfg *IniCfg, sectionName string, callback func(*IniCfg, int)) uint32 {
+	return defaultMonitor().SubscribeSection(cfg, sectionName, callback)
+}
+
+// Unsubscribe removes the callback identified by id from the list of
+// subscribers for the given ini file. Once a config has no subscribers, and
+// neither a validator nor SetNotifyOnRawChange is set for it, its files are
+// no longer checked for changes.
+func Unsubscribe(cfg *IniCfg, id uint32) {
+	defaultMonitor().Unsubscribe(cfg, id)
+}
+
+// NewMonitor returns a new Monitor with the given options. The Monitor does
+// not detect changes until it is started.
+func NewMonitor(opts MonitorOptions) *Monitor {
+	mon := Monitor{
+		disableWatcher: opts.DisableWatcher,
+		monitors:       make(map[*liveCfg]*monIni),
+		rescan:         make(chan struct{}, 1),
 	}
 
-	mon.subscribers[sub.id] = sub
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollFreqSec * time.Second
+	}
 
-	callback(mon.iniFile, 0)
+	mon.SetPollInterval(opts.PollInterval)
 
-	return newId
+	return &mon
 }
 
-// Unsubscribe removes the callback identified by id from the list of
-// subscribers for the given ini file.
-func Unsubscribe(cfg *IniCfg, id uint32) {
-	monitorLock.Lock()
-	defer monitorLock.Unlock()
+// ClearSubscribers clears the list of subscriber functions for the given
+// ini file.
+func (this *Monitor) ClearSubscribers(cfg *IniCfg) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	mon := this.findMonIni(cfg)
+	if mon == nil {
+		return
+	}
 
-	mon := getMonIni(cfg)
-	delete(mon.subscribers, id)
+	for k := range mon.subscribers {
+		mon.subscribers[k].stop()
+	}
+
+	mon.subscribers = make(map[uint32]*monSubscriber)
+	this.release(mon)
 }
 
-// getMonIni creates, or gets, a monIni object for tracking callbacks
-// associated with the given ini file.
-func getMonIni(cfg *IniCfg) *monIni {
-	if monitors == nil {
-		monitors = make(map[string]*monIni)
+// ForceUpdate checks the monitor's files for changes, whether or not the
+// monitor is running. It returns once every subscriber has been notified of
+// any changes detected, and so must not be called from within a subscriber
+// callback. Channels returned by Watch are the exception: since delivery to
+// them depends on the receiver, ForceUpdate does not wait for their events.
+func (this *Monitor) ForceUpdate() {
+	delivered := this.checkInis()
+	this.flushSubscribers(delivered)
+	delivered.Wait()
+}
+
+// LastRejection returns the most recently rejected version of the given ini
+// file, or nil if the most recent change was published successfully.
+func (this *Monitor) LastRejection(cfg *IniCfg) *Rejection {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	mon := this.findMonIni(cfg)
+	if mon == nil {
+		return nil
 	}
 
-	mon, ok := monitors[cfg.Name]
-	if !ok {
-		mon = &monIni{
-			name:        cfg.Name,
-			iniFile:     cfg,
-			subscribers: make(map[uint32]*monSubscriber),
+	return mon.rejected
+}
+
+// PollInterval returns the interval at which files are checked for changes
+// when they cannot be watched.
+func (this *Monitor) PollInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.pollInterval))
+}
+
+// SetNotifyOnRawChange controls whether subscribers to the given ini file are
+// notified of changes which do not affect its ConfigVer. See the package
+// level SetNotifyOnRawChange.
+func (this *Monitor) SetNotifyOnRawChange(cfg *IniCfg, enabled bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !enabled && this.findMonIni(cfg) == nil {
+		return
+	}
+
+	mon := this.getMonIni(cfg)
+	mon.notifyRaw = enabled
+	this.release(mon)
+}
+
+// SetPollInterval sets the interval at which files are checked for changes
+// when they cannot be watched. The new interval takes effect after the
+// current one has elapsed.
+func (this *Monitor) SetPollInterval(interval time.Duration) {
+	atomic.StoreInt64(&this.pollInterval, int64(interval))
+}
+
+// SetValidator registers a function which is called with each new version of
+// the given ini file before it is published. See the package level
+// SetValidator.
+func (this *Monitor) SetValidator(cfg *IniCfg, validator func(*IniCfg) error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if validator == nil && this.findMonIni(cfg) == nil {
+		return
+	}
+
+	mon := this.getMonIni(cfg)
+	mon.validator = validator
+	this.release(mon)
+}
+
+// Start begins detecting changes to the monitor's files in a separate
+// goroutine. Where possible, an event driven file watcher (inotify on
+// Linux) is used to trigger checks as soon as a file is written; otherwise,
+// or if any file cannot be watched, files are polled every PollInterval.
+// Calling Start on a running monitor has no effect.
+func (this *Monitor) Start() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stop != nil {
+		return
+	}
+
+	if !this.disableWatcher {
+		this.watcher, _ = newWatcher()
+	}
+
+	for k := range this.monitors {
+		this.watchFiles(this.monitors[k].iniFile.Snapshot())
+	}
+
+	this.done = make(chan struct{})
+	this.stop = make(chan struct{})
+
+	go this.monitorInis(this.stop, this.done, this.watcher)
+}
+
+// Stop stops the monitor's goroutine, waiting for it to exit until ctx is
+// cancelled, in which case ctx's error is returned. Subscriptions are
+// retained, and the monitor may be restarted with Start.
+func (this *Monitor) Stop(ctx context.Context) error {
+	this.lock.Lock()
+
+	stop, done := this.stop, this.done
+	this.done = nil
+	this.stop = nil
+	this.watcher = nil
+
+	this.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe registers a callback which is called upon any changes to the
+// given ini file. See the package level Subscribe.
+func (this *Monitor) Subscribe(cfg *IniCfg, callback func(*IniCfg, int)) uint32 {
+	return this.subscribe(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+		if ev.Type == EventChanged {
+			callback(ev.Cfg, ev.ChangeCount)
+		}
+	}, nil, false)
+}
+
+// SubscribeDiff registers a callback which receives the differences between
+// successive snapshots of the given ini file. See the package level
+// SubscribeDiff.
+func (this *Monitor) SubscribeDiff(cfg *IniCfg, callback func(*IniCfg, *ConfigDiff)) uint32 {
+	return this.subscribe(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+		if ev.Type == EventChanged {
+			callback(ev.Cfg, ev.Diff())
+		}
+	}, nil, false)
+}
+
+// SubscribeKey registers a callback which is called when the values of the
+// given key change. See the package level SubscribeKey.
+func (this *Monitor) SubscribeKey(
+	cfg *IniCfg,
+	sectionName, key string,
+	callback func(*IniCfg, int),
+) uint32 {
+	secName := cleanIniToken(sectionName)
+	ckey := cleanIniToken(key)
+
+	return this.subscribe(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+		if ev.Type != EventChanged {
+			return
+		}
+
+		if ev.Old != nil && equalInstances(
+			instancesOf(ev.Old.GetSection(secName).Values[ckey]),
+			instancesOf(ev.Cfg.GetSection(secName).Values[ckey]),
+		) {
+			return
+		}
+
+		callback(ev.Cfg, ev.ChangeCount)
+	}, nil, false)
+}
+
+// SubscribeSection registers a callback which is called when the given
+// section changes. See the package level SubscribeSection.
+func (this *Monitor) SubscribeSection(
+	cfg *IniCfg,
+	sectionName string,
+	callback func(*IniCfg, int),
+) uint32 {
+	secName := cleanIniToken(sectionName)
+
+	return this.subscribe(context.Background(), cfg, SubscribeOptions{}, func(ev Event) {
+		if ev.Type != EventChanged {
+			return
+		}
+
+		if ev.Old != nil {
+			oldSec, inOld := ev.Old.Sections[secName]
+			newSec, inNew := ev.Cfg.Sections[secName]
+
+			if inOld == inNew && (!inOld || oldSec.ConfigVer == newSec.ConfigVer) {
+				return
+			}
 		}
 
-		monitors[cfg.Name] = mon
+		callback(ev.Cfg, ev.ChangeCount)
+	}, nil, false)
+}
+
+// Unsubscribe removes the callback identified by id from the list of
+// subscribers for the given ini file.
+func (this *Monitor) Unsubscribe(cfg *IniCfg, id uint32) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	mon := this.findMonIni(cfg)
+	if mon == nil {
+		return
 	}
 
-	return mon
+	sub, ok := mon.subscribers[id]
+	if ok {
+		delete(mon.subscribers, id)
+		sub.stop()
+	}
+
+	this.release(mon)
 }
 
 // checkInis locks the monitor list and does the work of detecting
 // config changes and running the registered callbacks in the event
-// that a relevant config file has been changed.
-func checkInis() {
-	monitorLock.Lock()
-
-	for k1 := range monitors {
+// that a relevant config file has been changed. A file is read only if
+// its size or modification time differ from when it was last examined,
+// and is considered changed only if its content differs from that which
+// was last parsed, so that touching a file, or restoring one with an
+// older modification time, is handled correctly. Glob patterns named by
+// include directives are expanded again, so that files added to or removed
+// from an included directory are detected. Subscribers are notified
+// when a file is removed, reappears or cannot be read; a removed file's
+// values are dropped only if the config's IgnoreMissing option is set, and
+// an unreadable file's last good values are always kept. Changed configs are
+// reparsed into new snapshots which, once validated, are published
+// atomically, so that concurrent readers never observe a partially parsed
+// or invalid config; subscribers are notified of rejected versions with an
+// EventRejected event. Subscribers are notified of published snapshots if
+// the config's ConfigVer has changed (or on any change, if
+// SetNotifyOnRawChange is enabled). Notifications are queued for delivery
+// by each subscriber's goroutine; the returned WaitGroup completes once they
+// have all been delivered.
+func (this *Monitor) checkInis() *sync.WaitGroup {
+	var delivered sync.WaitGroup
+
+	this.lock.Lock()
+
+	for k1 := range this.monitors {
 		changesDetected := false
 
-		mon := monitors[k1]
-		for iniFilePathIndex, iniFilePath := range mon.iniFile.Paths {
-			info, err := os.Stat(iniFilePath)
+		mon := this.monitors[k1]
+		cur := mon.iniFile.Snapshot()
+
+		if cur.inMemory {
+			continue
+		}
+
+		if len(mon.files) != len(cur.Paths) {
+			// the config was reparsed in place
+			mon.trackFiles(nil, cur)
+		}
+
+		for iniFilePathIndex, iniFilePath := range cur.Paths {
+			last := &mon.files[iniFilePathIndex]
+
+			info, err := cur.stat(iniFilePathIndex)
+			if err != nil && os.IsNotExist(err) {
+				if !last.missing {
+					*last = monFile{missing: true, size: -1}
+					mon.notifyFile(EventFileRemoved, iniFilePath, nil, &delivered)
+
+					// without the IgnoreMissing option, the last good
+					// values are kept until the file is restored
+					if cur.opts.IgnoreMissing && cur.Raws[iniFilePathIndex] != "" {
+						changesDetected = true
+					}
+				}
+
+				continue
+			}
+
 			if err != nil {
+				mon.unreadable(last, iniFilePath, err, &delivered)
+				continue
+			}
+
+			if last.missing {
+				last.missing = false
+				mon.notifyFile(EventFileAppeared, iniFilePath, nil, &delivered)
+			}
+
+			// file hasn't been touched since it was last examined
+			if info.Size() == last.size && info.ModTime().Equal(last.modTime) {
 				continue
 			}
 
-			// file hasn't been written to
-			if mon.iniFile.ModTimes[iniFilePathIndex].After(info.ModTime()) ||
-				mon.iniFile.ModTimes[iniFilePathIndex].Equal(info.ModTime()) {
+			content, err := cur.readContent(iniFilePathIndex)
+			if err != nil {
+				mon.unreadable(last, iniFilePath, err, &delivered)
 				continue
 			}
 
-			// The file has been written to; this configuration's subscribers should be notified.
-			changesDetected = true
+			last.modTime = info.ModTime()
+			last.size = info.Size()
+			last.unreadable = false
+
+			// The file's content has changed; it should be reparsed.
+			if string(content) != cur.Raws[iniFilePathIndex] {
+				changesDetected = true
+			}
+		}
+
+		// files have been added to, or removed from, an included directory
+		for i := range mon.globs {
+			if mon.globs[i].refresh() {
+				changesDetected = true
+			}
 		}
 
 		if changesDetected {
-			// something has changed - reparse
+			// something has changed - reparse into a new snapshot
+			next, err := cur.reload()
+			if err == nil && mon.validator != nil {
+				err = mon.validator(next)
+			}
+
+			if err != nil {
+				mon.reject(next, err, &delivered)
+				continue
+			}
+
+			mon.iniFile.publish(next)
+			mon.rejected = nil
+
+			// the set of included files may have changed
+			mon.trackFiles(cur, next)
+			this.watchFiles(next)
+
+			if next.ConfigVer == cur.ConfigVer && !mon.notifyRaw {
+				continue
+			}
+
 			mon.changeCount++
-			mon.iniFile.Reparse()
 
 			// notify
 			for k2 := range mon.subscribers {
-				sub := mon.subscribers[k2]
-				sub.callback(mon.iniFile, mon.changeCount)
+				mon.subscribers[k2].enqueue(Event{
+					Type:        EventChanged,
+					Cfg:         next,
+					Old:         cur,
+					ChangeCount: mon.changeCount,
+				}, &delivered)
 			}
 		}
 	}
 
-	monitorLock.Unlock()
+	this.lock.Unlock()
+
+	return &delivered
 }
 
-// monitorInis is executed within a separate goroutine to periodically
-// stat monitored ini files. Changes are detected by comparing an ini file's
-// ModTime with the last recorded ModTime (at the time the file was last
-// parsed). If changes are detected, all subscribed callbacks are called.
-func monitorInis() {
-	defer iniShutdown.Complete()
+// flushSubscribers queues a flush with every subscriber, so that done
+// completes only once all events queued so far, including those from
+// earlier checks, have been delivered.
+func (this *Monitor) flushSubscribers(done *sync.WaitGroup) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for k1 := range this.monitors {
+		for k2 := range this.monitors[k1].subscribers {
+			this.monitors[k1].subscribers[k2].flush(done)
+		}
+	}
+}
+
+// findMonIni gets the monIni object tracking the given ini file, or returns
+// nil if the file is not monitored.
+func (this *Monitor) findMonIni(cfg *IniCfg) *monIni {
+	return this.monitors[cfg.live]
+}
+
+// release stops monitoring the ini file tracked by mon once it no longer has
+// any subscribers, validator or raw change notification setting, so that
+// configs which are no longer of interest are not checked forever. The
+// caller must hold the monitor's lock.
+func (this *Monitor) release(mon *monIni) {
+	if len(mon.subscribers) > 0 || mon.validator != nil || mon.notifyRaw {
+		return
+	}
+
+	if this.monitors[mon.iniFile.live] == mon {
+		delete(this.monitors, mon.iniFile.live)
+	}
+}
+
+// getMonIni creates, or gets, a monIni object for tracking callbacks
+// associated with the given ini file. Monitors are keyed by the live state
+// shared between a config and its snapshots, rather than by name, so that
+// distinct configs loaded from files with the same name are tracked
+// independently.
+func (this *Monitor) getMonIni(cfg *IniCfg) *monIni {
+	mon, ok := this.monitors[cfg.live]
+	if !ok {
+		cur := cfg.Snapshot()
+
+		mon = &monIni{
+			name:        cfg.Name,
+			iniFile:     cfg,
+			subscribers: make(map[uint32]*monSubscriber),
+		}
+
+		mon.trackFiles(nil, cur)
+		this.monitors[cfg.live] = mon
+		this.watchFiles(cur)
+	}
+
+	return mon
+}
+
+// mustPoll returns true if any monitored config has files which cannot be
+// watched, because they are read from an fs.FS.
+func (this *Monitor) mustPoll() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for k := range this.monitors {
+		cur := this.monitors[k].iniFile.Snapshot()
+		if !cur.inMemory && cur.hasFSLayers() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// monitorInis is executed within a separate goroutine to detect changes
+// to monitored ini files, until stop is closed. Changes are detected, and
+// subscribers notified, as described by checkInis. Files are polled if the
+// watcher is unavailable, or if any are read from an fs.FS.
+func (this *Monitor) monitorInis(stop, done chan struct{}, w watcher) {
+	defer close(done)
+	defer crash.HandleAll()
+
+	var watchEvents <-chan struct{}
+	if w != nil {
+		defer w.close()
+		watchEvents = w.events()
+	}
 
 	for {
+		var pollChan <-chan time.Time
+		if w == nil || !w.healthy() || this.mustPoll() {
+			pollChan = time.After(this.PollInterval())
+		}
+
 		select {
-		case replyChan := <-forceUpdateChan:
-			checkInis()
-			if replyChan != nil {
-				close(replyChan)
-			}
+		case <-watchEvents:
+			this.checkInis()
 
-		case <-time.After(time.Duration(atomic.LoadUint32(&pollFreqSec)) * time.Second):
-			checkInis()
+		case <-pollChan:
+			this.checkInis()
 
-		case <-iniShutdown.Signal:
+		case <-this.rescan:
+
+		case <-stop:
 			return
 		}
 	}
 }
+
+// subscribe registers the given notification function with the monitor for
+// the given ini file, calls it once with the current snapshot, and starts
+// the goroutine which delivers subsequent events to it. onClose, if not nil,
+// is called once no further events will be delivered. If detached is true,
+// ForceUpdate does not wait for events to be delivered to the subscriber.
+func (this *Monitor) subscribe(
+	ctx context.Context,
+	cfg *IniCfg,
+	opts SubscribeOptions,
+	notify func(Event),
+	onClose func(),
+	detached bool,
+) uint32 {
+	newId := atomic.AddUint32(&coreId, 1)
+
+	this.lock.Lock()
+
+	mon := this.getMonIni(cfg)
+
+	sub := &monSubscriber{
+		ctx:      ctx,
+		coalesce: opts.Coalesce,
+		detached: detached,
+		id:       newId,
+		mon:      mon,
+		monitor:  this,
+		notify:   notify,
+		onClose:  onClose,
+		wake:     make(chan struct{}, 1),
+	}
+
+	mon.subscribers[sub.id] = sub
+	cur := mon.iniFile.Snapshot()
+
+	this.lock.Unlock()
+
+	// changes published in the meantime are queued until the goroutine
+	// starts, so ordering is preserved
+	notify(Event{
+		Type: EventChanged,
+		Cfg:  cur,
+	})
+
+	go sub.run()
+
+	return newId
+}
+
+// watchFiles adds the files making up the given config, along with the
+// patterns of any globs it includes, to the watcher, if there is one. Files
+// read from an fs.FS are polled instead.
+func (this *Monitor) watchFiles(cur *IniCfg) {
+	if this.watcher == nil || cur.inMemory {
+		return
+	}
+
+	if cur.hasFSLayers() {
+		// wake the monitor's goroutine, so that it begins polling
+		select {
+		case this.rescan <- struct{}{}:
+		default:
+		}
+	}
+
+	for i := range cur.Paths {
+		if cur.layerFS(i) == nil {
+			this.watcher.add(cur.Paths[i])
+		}
+	}
+
+	for i := range cur.globs {
+		if cur.globs[i].fsys == nil {
+			this.watcher.add(cur.globs[i].pattern)
+		}
+	}
+}
+
+// notifyFile notifies subscribers of a file lifecycle event.
+func (this *monIni) notifyFile(
+	eventType EventType,
+	filePath string,
+	err error,
+	delivered *sync.WaitGroup,
+) {
+	for k := range this.subscribers {
+		this.subscribers[k].enqueue(Event{
+			Type:        eventType,
+			Cfg:         this.iniFile.Snapshot(),
+			ChangeCount: this.changeCount,
+			Err:         err,
+			Path:        filePath,
+		}, delivered)
+	}
+}
+
+// trackFiles records the files and include globs making up cur, which
+// replaces prev (which may be nil). What is known of each file which was
+// also part of prev is carried over, so that it is not needlessly read
+// again.
+func (this *monIni) trackFiles(prev, cur *IniCfg) {
+	if cur.inMemory {
+		// there are no files to monitor
+		this.files = nil
+		this.globs = nil
+		return
+	}
+
+	known := make(map[string]monFile)
+	if prev != nil {
+		for i := range prev.Paths {
+			if i < len(this.files) {
+				known[prev.Paths[i]] = this.files[i]
+			}
+		}
+	}
+
+	this.files = make([]monFile, len(cur.Paths))
+
+	for i := range this.files {
+		if last, ok := known[cur.Paths[i]]; ok {
+			this.files[i] = last
+			continue
+		}
+
+		this.files[i].modTime = cur.ModTimes[i]
+		this.files[i].size = int64(len(cur.Raws[i]))
+
+		_, err := cur.stat(i)
+		if err != nil && os.IsNotExist(err) {
+			this.files[i] = monFile{missing: true, size: -1}
+		}
+	}
+
+	this.globs = make([]includeGlob, len(cur.globs))
+	copy(this.globs, cur.globs)
+}
+
+// unreadable records that a file could not be read, notifying subscribers
+// the first time this happens. The last good values from the file are kept,
+// and the file is read again on the next check.
+func (this *monIni) unreadable(
+	last *monFile,
+	filePath string,
+	err error,
+	delivered *sync.WaitGroup,
+) {
+	if last.unreadable {
+		return
+	}
+
+	last.unreadable = true
+	this.notifyFile(EventFileUnreadable, filePath, err, delivered)
+}
+
+// reject records a version of the config which could not be parsed, or which
+// failed validation, and notifies subscribers. rejected is never nil; if the
+// files could not be parsed, it holds everything parsed up until the failure.
+func (this *monIni) reject(rejected *IniCfg, err error, delivered *sync.WaitGroup) {
+	this.rejected = &Rejection{
+		Cfg:       rejected,
+		ConfigVer: rejected.ConfigVer,
+		Err:       err,
+	}
+
+	for k := range this.subscribers {
+		this.subscribers[k].enqueue(Event{
+			Type:        EventRejected,
+			Cfg:         this.iniFile.Snapshot(),
+			ChangeCount: this.changeCount,
+			Err:         err,
+			Rejected:    this.rejected,
+		}, delivered)
+	}
+}
+
+// defaultMonitor returns the monitor used by the package level monitoring
+// functions, creating and starting it if necessary.
+func defaultMonitor() *Monitor {
+	defaultMonOnce.Do(initDefaultMonitor)
+	defaultMon.Start()
+
+	return defaultMon
+}
+
+// initDefaultMonitor creates the default monitor.
+func initDefaultMonitor() {
+	defaultMon = NewMonitor(MonitorOptions{})
+}
@@ -0,0 +1,172 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniProvenance.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Source identifies where an IniValue was defined. Path and Line locate the
+// line defining the value, and Layer is the index within the config's Paths
+// of the file containing it. Layer is -1 for values which do not belong to a
+// config, such as VoidValue.
+type Source struct {
+	Path  string
+	Line  int
+	Layer int
+}
+
+// Definition describes a single line defining a key, as reported by Explain.
+// Active is false if the definition was discarded when merging the config's
+// files (see MergeStrategy). Winner is true for the definition returned by
+// IniSection.GetVal.
+type Definition struct {
+	Source Source
+	Values []string
+	Active bool
+	Winner bool
+}
+
+// Explanation lists every definition of a key across a config's files, in
+// file and line order. See IniCfg.Explain.
+type Explanation struct {
+	Section     string
+	Key         string
+	Definitions []Definition
+}
+
+// Explain reports every definition of the given key within the named section
+// across all of the config's files, including those discarded by the merge
+// strategy, and which of them takes precedence.
+func (this *IniCfg) Explain(sectionName, key string) *Explanation {
+	explanation := Explanation{
+		Section:     cleanIniToken(sectionName),
+		Key:         cleanIniToken(key),
+		Definitions: make([]Definition, 0),
+	}
+
+	sec := this.GetSection(explanation.Section)
+	active := make(map[*IniLine]*IniValue)
+	for _, val := range sec.GetVals(explanation.Key) {
+		active[val.line] = val
+	}
+
+	winner := sec.GetVal(explanation.Key)
+
+	for layer, doc := range this.docs {
+		curSection := ""
+
+		for _, line := range doc.Lines {
+			switch line.Kind {
+			case SectionLine:
+				curSection = cleanIniToken(line.Name)
+				continue
+			case KeyValLine:
+			default:
+				continue
+			}
+
+			lineKey, _ := this.mergeStrategy(line.Name)
+			if curSection != explanation.Section || cleanIniToken(lineKey) != explanation.Key {
+				continue
+			}
+
+			def := Definition{
+				Source: Source{
+					Path:  doc.Path,
+					Line:  line.Num,
+					Layer: layer,
+				},
+				Winner: winner.line == line,
+			}
+
+			if val, ok := active[line]; ok {
+				def.Active = true
+				def.Values = val.Values
+			} else {
+				val, _ := this.parseValue(lineKey, line.token())
+				def.Values = val.Values
+			}
+
+			explanation.Definitions = append(explanation.Definitions, def)
+		}
+	}
+
+	return &explanation
+}
+
+// Source returns the location at which the value was defined.
+func (this *IniValue) Source() Source {
+	src := Source{
+		Layer: -1,
+	}
+
+	if this.line != nil {
+		src.Line = this.line.Num
+	}
+
+	if this.doc == nil {
+		return src
+	}
+
+	src.Path = this.doc.Path
+
+	if this.section != nil && this.section.cfg != nil {
+		for i := range this.section.cfg.docs {
+			if this.section.cfg.docs[i] == this.doc {
+				src.Layer = i
+				break
+			}
+		}
+	}
+
+	return src
+}
+
+// String prints a human-readable report of the key's definitions.
+func (this *Explanation) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("[%s] %s\n", this.Section, this.Key))
+
+	if len(this.Definitions) < 1 {
+		buf.WriteString("    not defined\n")
+	}
+
+	for _, def := range this.Definitions {
+		status := "overridden"
+		switch {
+		case def.Winner:
+			status = "wins"
+		case def.Active:
+			status = "merged"
+		}
+
+		buf.WriteString(fmt.Sprintf(
+			"    %s layer %d %s:%d = %s\n",
+			status,
+			def.Source.Layer,
+			def.Source.Path,
+			def.Source.Line,
+			strings.Join(def.Values, ", "),
+		))
+	}
+
+	return buf.String()
+}
+
+// String returns the source in "path:line" form.
+func (this Source) String() string {
+	return fmt.Sprintf("%s:%d", this.Path, this.Line)
+}
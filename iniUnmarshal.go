@@ -0,0 +1,424 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniUnmarshal.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+package ini
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Shared reflect types.
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Unmarshal populates the struct pointed to by v from the configuration.
+// Each exported field of struct (or pointer to struct) type is bound to the
+// section named by its `ini:"name"` tag, or by its field name if no tag is
+// present, and is populated as described by IniSection.Unmarshal. Fields of
+// other types are ignored, as are fields tagged `ini:"-"`. Embedded structs
+// are treated as though their fields were declared in v itself.
+//
+// Sections which are not present in the configuration are treated as though
+// they were empty, so that default values are applied to them, with the
+// exception of pointer fields, which are left untouched. A section field
+// tagged `required:"true"` must be present in the configuration.
+//
+// If a value cannot be converted, an *UnmarshalError naming the section, key
+// and offset of the value is returned. Otherwise, if any required sections or
+// keys are missing, a *RequiredError listing all of them is returned.
+func (this *IniCfg) Unmarshal(v interface{}) error {
+	rv, err := structPtr(v)
+	if err != nil {
+		return err
+	}
+
+	state := unmarshalState{}
+
+	if err = this.unmarshalStruct(rv, &state); err != nil {
+		return err
+	}
+
+	return state.err()
+}
+
+// Unmarshal populates the struct pointed to by v from the key/value pairs
+// within the section. Each exported field is bound to the key named by its
+// `ini:"name"` tag, or by its field name if no tag is present; names are
+// matched in the same case insensitive manner as GetVals. Fields tagged
+// `ini:"-"` are ignored, and embedded structs are treated as though their
+// fields were declared in v itself.
+//
+// Scalar fields receive the value at offset 0 of the instance of their key
+// which takes precedence, mirroring GetVal(key).GetValX(0, ...), so that
+// values from later files override those from earlier ones. Slice fields
+// receive every comma separated value of that instance, and slice of slice
+// fields receive one slice for each instance of a repeated key. Strings, booleans,
+// integers, unsigned integers and floats of every size are supported, as are
+// time.Duration and any type implementing encoding.TextUnmarshaler, along with
+// pointers to all of these.
+//
+// Keys which are not present in the section receive the value of their
+// field's `default:"..."` tag, parsed as though it had been read from the
+// ini file, or are left untouched if there is no such tag. Fields tagged
+// `required:"true"` must be present in the section.
+//
+// If a value cannot be converted, an *UnmarshalError naming the section, key
+// and offset of the value is returned. Otherwise, if any required keys are
+// missing, a *RequiredError listing all of them is returned.
+func (this *IniSection) Unmarshal(v interface{}) error {
+	rv, err := structPtr(v)
+	if err != nil {
+		return err
+	}
+
+	state := unmarshalState{}
+
+	if err = this.unmarshalStruct(rv, &state); err != nil {
+		return err
+	}
+
+	return state.err()
+}
+
+// unmarshalState accumulates the required sections and keys found to be
+// missing over the course of a single Unmarshal call.
+type unmarshalState struct {
+	missing []MissingKey
+}
+
+// err returns a *RequiredError if any required sections or keys were
+// missing, or nil otherwise.
+func (this *unmarshalState) err() error {
+	if len(this.missing) < 1 {
+		return nil
+	}
+
+	return &RequiredError{Missing: this.missing}
+}
+
+// unmarshalStruct binds the sections of the config to the struct held in rv.
+func (this *IniCfg) unmarshalStruct(rv reflect.Value, state *unmarshalState) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if field.Anonymous && indirectType(field.Type).Kind() == reflect.Struct {
+			if err := this.unmarshalStruct(allocPtr(fv), state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !isSectionType(field.Type) {
+			continue
+		}
+
+		sec, ok := this.Sections[name]
+		if !ok {
+			if isRequired(field) {
+				state.missing = append(state.missing, MissingKey{Section: name})
+				continue
+			}
+
+			if field.Type.Kind() == reflect.Ptr {
+				continue
+			}
+
+			// apply defaults and check required keys
+			sec = newIniSection(name)
+		}
+
+		if err := sec.unmarshalStruct(allocPtr(fv), state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalStruct binds the key/value pairs of the section to the struct
+// held in rv.
+func (this *IniSection) unmarshalStruct(rv reflect.Value, state *unmarshalState) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+
+		name, ok := fieldName(field)
+		if !ok {
+			continue
+		}
+
+		fv := rv.Field(i)
+
+		if field.Anonymous && isSectionType(field.Type) {
+			if err := this.unmarshalStruct(allocPtr(fv), state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		vals, ok := this.Values[name]
+		if !ok || len(vals) < 1 {
+			def, hasDef := field.Tag.Lookup("default")
+
+			switch {
+			case hasDef:
+				vals = []*IniValue{newIniValue(name, def)}
+			case isRequired(field):
+				state.missing = append(state.missing, MissingKey{
+					Section: this.Name,
+					Key:     name,
+				})
+				continue
+			default:
+				continue
+			}
+		}
+
+		if err := this.unmarshalKey(name, vals, fv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalKey converts the given instances of a key into the field held
+// in fv.
+func (this *IniSection) unmarshalKey(key string, vals []*IniValue, fv reflect.Value) error {
+	ft := fv.Type()
+
+	switch {
+	case isSliceType(ft) && isSliceType(ft.Elem()):
+		out := reflect.MakeSlice(ft, len(vals), len(vals))
+		for i := range vals {
+			err := this.unmarshalValues(key, i, vals[i].Values, out.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		fv.Set(out)
+
+	case isSliceType(ft):
+		i := this.precedent(len(vals))
+		return this.unmarshalValues(key, i, vals[i].Values, fv)
+
+	default:
+		i := this.precedent(len(vals))
+		if len(vals[i].Values) < 1 {
+			return nil
+		}
+
+		err := setScalar(fv, vals[i].Values[0])
+		if err != nil {
+			return this.unmarshalError(key, i, 0, vals[i].Values[0], ft, err)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalValues converts the comma separated values of a single instance
+// of a key into the slice held in fv.
+func (this *IniSection) unmarshalValues(key string, instance int, values []string, fv reflect.Value) error {
+	out := reflect.MakeSlice(fv.Type(), len(values), len(values))
+
+	for i := range values {
+		err := setScalar(out.Index(i), values[i])
+		if err != nil {
+			return this.unmarshalError(key, instance, i, values[i], fv.Type().Elem(), err)
+		}
+	}
+
+	fv.Set(out)
+
+	return nil
+}
+
+// unmarshalError returns a new *UnmarshalError for a value within the
+// section.
+func (this *IniSection) unmarshalError(
+	key string,
+	instance, offset int,
+	value string,
+	typ reflect.Type,
+	err error,
+) error {
+	return &UnmarshalError{
+		Section:  this.Name,
+		Key:      key,
+		Instance: instance,
+		Offset:   offset,
+		Value:    value,
+		Type:     typ,
+		Err:      err,
+	}
+}
+
+// setScalar parses the string s according to the type of fv and stores the
+// result in fv.
+func setScalar(fv reflect.Value, s string) error {
+	ft := fv.Type()
+
+	if ft.Kind() == reflect.Ptr {
+		ptr := reflect.New(ft.Elem())
+		if err := setScalar(ptr.Elem(), s); err != nil {
+			return err
+		}
+
+		fv.Set(ptr)
+		return nil
+	}
+
+	if reflect.PtrTo(ft).Implements(textUnmarshalerType) {
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	if ft == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch ft.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+
+	case reflect.Bool:
+		bVal, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(bVal)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		iVal, err := strconv.ParseInt(s, 10, ft.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(iVal)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		uVal, err := strconv.ParseUint(s, 10, ft.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(uVal)
+
+	case reflect.Float32, reflect.Float64:
+		fVal, err := strconv.ParseFloat(s, ft.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(fVal)
+
+	default:
+		return fmt.Errorf("unsupported type %s", ft)
+	}
+
+	return nil
+}
+
+// structPtr verifies that v is a non-nil pointer to a struct and returns
+// the struct it points to.
+func structPtr(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, ErrInvalidTarget
+	}
+
+	return rv.Elem(), nil
+}
+
+// fieldName returns the ini section or key name bound to the given struct
+// field, and false if the field should be ignored.
+func fieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" && (!field.Anonymous || field.Type.Kind() == reflect.Ptr) {
+		// unexported
+		return "", false
+	}
+
+	tag := field.Tag.Get("ini")
+	if tag == "-" {
+		return "", false
+	}
+
+	if tag == "" {
+		tag = field.Name
+	}
+
+	return cleanIniToken(tag), true
+}
+
+// isRequired returns true if the given struct field is tagged
+// `required:"true"`.
+func isRequired(field reflect.StructField) bool {
+	required, _ := strconv.ParseBool(field.Tag.Get("required"))
+	return required
+}
+
+// allocPtr returns the struct held in fv, allocating it first if fv is a
+// nil pointer.
+func allocPtr(fv reflect.Value) reflect.Value {
+	if fv.Kind() != reflect.Ptr {
+		return fv
+	}
+
+	if fv.IsNil() {
+		fv.Set(reflect.New(fv.Type().Elem()))
+	}
+
+	return fv.Elem()
+}
+
+// indirectType returns the type pointed to by t if t is a pointer type,
+// otherwise t itself.
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+
+	return t
+}
+
+// isSectionType returns true if fields of type t are bound to an entire
+// section rather than to a single key.
+func isSectionType(t reflect.Type) bool {
+	t = indirectType(t)
+
+	return t.Kind() == reflect.Struct &&
+		!reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
+
+// isSliceType returns true if fields of type t receive multiple values.
+func isSliceType(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && !reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
@@ -0,0 +1,258 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniWatch_linux.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+//go:build linux
+// +build linux
+
+package ini
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyMask is the set of inotify events watched for on the parent
+// directories of monitored files. Watching the directory, rather than the
+// file itself, catches editors which save by renaming a temporary file over
+// the original, as well as Kubernetes ConfigMap volumes, which swap a
+// ..data symlink when their contents change.
+const inotifyMask = syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF |
+	syscall.IN_MODIFY |
+	syscall.IN_MOVE_SELF |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO
+
+// inotifyWatcher is the inotify backed watcher implementation.
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	notify chan struct{}
+
+	lock    sync.Mutex
+	dirs    map[int32]map[string]bool
+	failed  bool
+	targets map[int32]bool
+	timer   *time.Timer
+}
+
+// newWatcher returns a new inotify backed watcher.
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := inotifyWatcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		notify:  make(chan struct{}, 1),
+		dirs:    make(map[int32]map[string]bool),
+		targets: make(map[int32]bool),
+	}
+
+	go w.readEvents()
+
+	return &w, nil
+}
+
+// add begins watching the parent directory of the given file, or glob
+// pattern, for events affecting it. If the file is reached through a
+// symlink, the directory containing its target is watched as well, so that
+// changes made to the target in place are seen.
+func (this *inotifyWatcher) add(filePath string) error {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return this.fail(err)
+	}
+
+	dir, name := filepath.Split(absPath)
+	if err = this.addDir(dir, name, false); err != nil {
+		return err
+	}
+
+	target, err := filepath.EvalSymlinks(absPath)
+	if err != nil || target == absPath {
+		// missing files, and glob patterns, have nothing to resolve
+		return nil
+	}
+
+	dir, name = filepath.Split(target)
+
+	return this.addDir(dir, name, true)
+}
+
+// addDir begins watching the given directory for events affecting the file,
+// or files matching the glob pattern, with the given name. target is true if
+// the directory is watched only because it holds the target of a symlink.
+func (this *inotifyWatcher) addDir(dir, name string, target bool) error {
+	wd, err := syscall.InotifyAddWatch(this.fd, dir, inotifyMask)
+	if err != nil {
+		return this.fail(os.NewSyscallError("inotify_add_watch", err))
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	names, ok := this.dirs[int32(wd)]
+	if !ok {
+		names = make(map[string]bool)
+		this.dirs[int32(wd)] = names
+		this.targets[int32(wd)] = target
+	}
+
+	if !target {
+		this.targets[int32(wd)] = false
+	}
+
+	names[name] = true
+
+	return nil
+}
+
+// close stops watching for events.
+func (this *inotifyWatcher) close() {
+	this.file.Close()
+}
+
+// events returns the channel which is signalled, after a short debounce
+// period, whenever a watched file may have changed.
+func (this *inotifyWatcher) events() <-chan struct{} {
+	return this.notify
+}
+
+// healthy returns false if any file could not be watched, or if the watch on
+// one of the watched directories has been lost.
+func (this *inotifyWatcher) healthy() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return !this.failed
+}
+
+// fail marks the watcher as unhealthy and wakes the monitor so that it falls
+// back to polling.
+func (this *inotifyWatcher) fail(err error) error {
+	this.lock.Lock()
+	this.failed = true
+	this.lock.Unlock()
+
+	this.signal()
+
+	return err
+}
+
+// signal wakes the monitor without waiting for the debounce period.
+func (this *inotifyWatcher) signal() {
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+}
+
+// debounce signals the monitor once no further events have been received
+// for watchDebounce, so that a burst of writes results in a single check.
+func (this *inotifyWatcher) debounce() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.timer == nil {
+		this.timer = time.AfterFunc(watchDebounce, this.signal)
+		return
+	}
+
+	this.timer.Stop()
+	this.timer.Reset(watchDebounce)
+}
+
+// readEvents reads and dispatches inotify events until the watcher is
+// closed.
+func (this *inotifyWatcher) readEvents() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+
+	for {
+		n, err := this.file.Read(buf[:])
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+
+			if nameEnd > n {
+				break
+			}
+
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			this.handleEvent(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+// handleEvent decides whether a single inotify event is relevant to any of
+// the watched files.
+func (this *inotifyWatcher) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		this.debounce()
+		return
+	}
+
+	this.lock.Lock()
+	names, ok := this.dirs[wd]
+
+	ignored := ok && mask&syscall.IN_IGNORED != 0
+	if ignored {
+		// the directory itself has gone away. The directories of
+		// symlink targets are replaced as the links are updated (as in
+		// ConfigMap volumes), and the links themselves remain watched.
+		delete(this.dirs, wd)
+		this.failed = this.failed || !this.targets[wd]
+		delete(this.targets, wd)
+	}
+
+	relevant := ok && (names[name] || strings.HasPrefix(name, "..") || matchesPattern(names, name))
+	this.lock.Unlock()
+
+	switch {
+	case ignored:
+		this.signal()
+	case relevant:
+		this.debounce()
+	}
+}
+
+// matchesPattern returns true if name matches any of the glob patterns among
+// the watched names.
+func matchesPattern(names map[string]bool, name string) bool {
+	for pattern := range names {
+		if !strings.ContainsAny(pattern, "*?[") {
+			continue
+		}
+
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,26 @@
+//  ---------------------------------------------------------------------------
+//
+//  iniWatch_other.go
+//
+//  Copyright (c) 2015, Jared Chavez.
+//  All rights reserved.
+//
+//  Use of this source code is governed by a BSD-style
+//  license that can be found in the LICENSE file.
+//
+//  -----------
+
+//go:build !linux
+// +build !linux
+
+package ini
+
+import (
+	"errors"
+)
+
+// newWatcher returns an error on platforms without an event driven watcher
+// implementation, causing the monitor to fall back to polling.
+func newWatcher() (watcher, error) {
+	return nil, errors.New("ini: file watching is not supported on this platform")
+}